@@ -10,18 +10,29 @@ import (
 
 func cleanCmd() *cobra.Command {
 	cmd := &cobra.Command{
-		Use:   "clean <namespace> <pvc-name> <local-mount-point>",
+		Use:   "clean [[<namespace>] <pvc-name>] <local-mount-point>",
 		Short: "Clean the mounted PVC",
-		Args:  cobra.ExactArgs(3),
+		Long: `Clean the mount session at <local-mount-point>.
+
+The session is looked up in the local state. If this machine has no record
+of it, pv-mounter pods in the namespace (optionally narrowed down to
+<pvc-name>) are searched for the session mounted on <local-mount-point>.`,
+		Args: cobra.RangeArgs(1, 3),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			namespace := args[0]
-			pvcName := args[1]
-			localMountPoint := args[2]
+			namespace, args, err := namespaceFromArgs(args, 2)
+			if err != nil {
+				return err
+			}
+			pvcName := ""
+			if len(args) == 2 {
+				pvcName = args[0]
+			}
+			localMountPoint := args[len(args)-1]
 
 			// Create a context
 			ctx := context.Background()
 
-			if err := plugin.Clean(ctx, namespace, pvcName, localMountPoint); err != nil {
+			if err := plugin.Clean(ctx, KubernetesConfigFlags, namespace, pvcName, localMountPoint); err != nil {
 				return fmt.Errorf("failed to clean PVC: %w", err)
 			}
 			return nil
@@ -0,0 +1,58 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fenio/pv-mounter/pkg/plugin"
+	"github.com/spf13/cobra"
+)
+
+func gcCmd() *cobra.Command {
+	var opts plugin.GCOptions
+	var allNamespaces bool
+
+	cmd := &cobra.Command{
+		Use:   "gc [--all-namespaces] [--max-age <duration>] [--dry-run] [--output table|json] [<namespace>...]",
+		Short: "Find and remove mount sessions that were left behind",
+		Long: `Find everything pv-mounter created in the given namespaces: exposer and
+proxy pods, ephemeral containers and session Leases. Stale sessions are
+removed:
+
+* their Lease expired, i.e. the client stopped renewing it,
+* they were mounted from this machine, which recorded them but no longer has them mounted,
+* or they're older than --max-age.
+
+Without <namespace> the one from --namespace or the active context is used.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			switch {
+			case allNamespaces:
+				if len(args) > 0 {
+					return fmt.Errorf("namespaces can't be given together with --all-namespaces")
+				}
+			case len(args) > 0:
+				opts.Namespaces = args
+			default:
+				namespace, _, err := namespaceFromArgs(args, 0)
+				if err != nil {
+					return err
+				}
+				opts.Namespaces = []string{namespace}
+			}
+
+			// Create a context
+			ctx := context.Background()
+
+			if err := plugin.GC(ctx, KubernetesConfigFlags, opts, cmd.OutOrStdout()); err != nil {
+				return fmt.Errorf("failed to collect sessions: %w", err)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVarP(&allNamespaces, "all-namespaces", "A", false, "Look in all namespaces")
+	cmd.Flags().DurationVar(&opts.MaxAge, "max-age", 0, "Also remove sessions older than this (e.g. 24h)")
+	cmd.Flags().BoolVar(&opts.DryRun, "dry-run", false, "Only show what would be removed")
+	cmd.Flags().StringVarP(&opts.Output, "output", "o", plugin.GCOutputTable, "Output format: table or json")
+	return cmd
+}
@@ -0,0 +1,27 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fenio/pv-mounter/pkg/plugin"
+	"github.com/spf13/cobra"
+)
+
+func listCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the PVCs mounted from this machine",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Create a context
+			ctx := context.Background()
+
+			if err := plugin.List(ctx, KubernetesConfigFlags, cmd.OutOrStdout()); err != nil {
+				return fmt.Errorf("failed to list mounts: %w", err)
+			}
+			return nil
+		},
+	}
+	return cmd
+}
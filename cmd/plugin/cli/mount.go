@@ -4,56 +4,126 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 
 	"github.com/fenio/pv-mounter/pkg/plugin"
 	"github.com/spf13/cobra"
 )
 
 func mountCmd() *cobra.Command {
-	var needsRoot bool
-	var debug bool
+	var opts plugin.MountOptions
+	var keyType string
 
 	cmd := &cobra.Command{
-		Use:   "mount [--needs-root] [--debug] <namespace> <pvc-name> <local-mount-point>",
+		Use:   "mount [--needs-root] [--read-only] [--sub-path <dir>] [--as-owner] [--inherit-identity] [--key-type <type>] [--ssh-agent] [--max-lifetime <duration>] [--keep-on-failure] [--foreground] [--debug] [<namespace>] <pvc-name> | pod/<name> | sts/<name> | deploy/<name> | job/<name> [--volume <name>] [--ordinal <n>] <local-mount-point>",
 		Short: "Mount a PVC to a local directory",
-		Args:  cobra.ExactArgs(3),
+		Long: `Mount a PVC to a local directory.
+
+Instead of a PVC, a volume of a pod can be named as pod/<name> together with
+--volume. PVC-backed volumes are mounted like their PVC, through that pod if
+need be; any other volume (emptyDir, configMap, secret, hostPath, CSI inline)
+through an ephemeral container in the pod.
+
+A StatefulSet, Deployment or Job can be named as sts/<name>, deploy/<name> or
+job/<name>. Their PVC is worked out from the claim templates or the pod
+template, and per-pod volumes are reached through the live pod; --ordinal
+picks the StatefulSet pod when there are several replicas, or the PVC of a
+pod it was scaled down from.`,
+		Args: cobra.RangeArgs(2, 3),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			// Check for NEEDS_ROOT environment variable
-			if needsRootEnv, exists := os.LookupEnv("NEEDS_ROOT"); exists {
-				// Convert the environment variable to a boolean
-				if parsedNeedsRoot, err := strconv.ParseBool(needsRootEnv); err == nil {
-					needsRoot = parsedNeedsRoot
-				} else {
-					return fmt.Errorf("invalid value for NEEDS_ROOT: %v", needsRootEnv)
-				}
+			if err := resolveMountOptions(cmd, &opts, keyType); err != nil {
+				return err
 			}
 
-			// Check for DEBUG environment variable
-			if debugEnv, exists := os.LookupEnv("DEBUG"); exists {
-				// Convert the environment variable to a boolean
-				if parsedDebug, err := strconv.ParseBool(debugEnv); err == nil {
-					debug = parsedDebug
-				} else {
-					return fmt.Errorf("invalid value for DEBUG: %v", debugEnv)
-				}
+			namespace, args, err := namespaceFromArgs(args, 2)
+			if err != nil {
+				return err
 			}
+			pvcName := args[0]
+			localMountPoint := args[1]
 
-			namespace := args[0]
-			pvcName := args[1]
-			localMountPoint := args[2]
+			// A signal cancels the mount, which then rolls back what it created
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
 
-			// Create a context
-			ctx := context.Background()
-
-			if err := plugin.Mount(ctx, namespace, pvcName, localMountPoint, needsRoot, debug); err != nil {
+			if err := plugin.Mount(ctx, KubernetesConfigFlags, namespace, pvcName, localMountPoint, opts); err != nil {
 				return fmt.Errorf("failed to mount PVC: %w", err)
 			}
 			return nil
 		},
 	}
 
-	cmd.Flags().BoolVar(&needsRoot, "needs-root", false, "Mount the filesystem using the root account")
-	cmd.Flags().BoolVar(&debug, "debug", false, "Enable debug mode to print additional information")
+	addMountFlags(cmd, &opts, &keyType)
+	cmd.Flags().BoolVar(&opts.KeepOnFailure, "keep-on-failure", false, "Leave the created resources in place when the mount fails, for debugging")
+	cmd.Flags().BoolVar(&opts.Foreground, "foreground", false, "Stay attached until Ctrl-C, then unmount and delete everything that was created")
 	return cmd
 }
+
+// addMountFlags adds the flags that shape the mount itself, shared by every
+// command that mounts a volume.
+func addMountFlags(cmd *cobra.Command, opts *plugin.MountOptions, keyType *string) {
+	cmd.Flags().BoolVar(&opts.NeedsRoot, "needs-root", false, "Mount the filesystem using the root account")
+	cmd.Flags().BoolVar(&opts.Debug, "debug", false, "Enable debug mode to print additional information")
+	cmd.Flags().BoolVar(&opts.ReadOnly, "read-only", false, "Mount the volume read-only in the pod and locally")
+	cmd.Flags().StringVar(&opts.SubPath, "sub-path", "", "Mount only this directory of the volume")
+	cmd.Flags().BoolVar(&opts.AsOwner, "as-owner", false, "Run the standalone pod as the owner of the volume root")
+	cmd.Flags().StringVar(keyType, "key-type", string(plugin.DefaultKeyType), "Algorithm of the generated SSH keys: ed25519, ecdsa-p256, ecdsa-p384 or rsa-3072")
+	cmd.Flags().BoolVar(&opts.SSHAgent, "ssh-agent", false, "Load the SSH key into ssh-agent (the running one, or a built-in one) instead of a temporary file")
+	cmd.Flags().BoolVar(&opts.InheritIdentity, "inherit-identity", false, "Run the ephemeral container with the UID, GID and SELinux context of the container that mounts the volume")
+	cmd.Flags().DurationVar(&opts.MaxLifetime, "max-lifetime", 0, "Stop the pods and the ephemeral container after this long, even if the mount is still in use; the stopped pods stay until clean or gc (default no limit)")
+	cmd.Flags().StringVar(&opts.Volume, "volume", "", "Volume of the pod or workload to mount; may be omitted when there's only one")
+	cmd.Flags().Int("ordinal", 0, "Pod of a sts/<name> target to mount the volume of; may be omitted when there's only one replica")
+	cmd.Flags().StringVar(&opts.TargetPod, "target-pod", "", "Pod to go through when several pods reference a ReadWriteOnce or ReadWriteOncePod PVC")
+	cmd.Flags().DurationVar(&opts.Timeout, "timeout", plugin.DefaultStartTimeout, "How long the pods and the ephemeral container may take to start")
+}
+
+// resolveMountOptions applies the environment overrides, the key type and
+// the flags that are only set when given.
+func resolveMountOptions(cmd *cobra.Command, opts *plugin.MountOptions, keyType string) error {
+	if cmd.Flags().Changed("ordinal") {
+		ordinal, err := cmd.Flags().GetInt("ordinal")
+		if err != nil {
+			return err
+		}
+		opts.Ordinal = &ordinal
+	}
+
+	// Environment variables override the flags
+	for _, env := range []struct {
+		name   string
+		target *bool
+	}{
+		{"NEEDS_ROOT", &opts.NeedsRoot},
+		{"DEBUG", &opts.Debug},
+		{"READ_ONLY", &opts.ReadOnly},
+		{"INHERIT_IDENTITY", &opts.InheritIdentity},
+		{"AS_OWNER", &opts.AsOwner},
+	} {
+		if err := boolFromEnv(env.name, env.target); err != nil {
+			return err
+		}
+	}
+
+	parsedKeyType, err := plugin.ParseKeyType(keyType)
+	if err != nil {
+		return err
+	}
+	opts.KeyType = parsedKeyType
+	return nil
+}
+
+// boolFromEnv sets target from the environment variable name, if it's set.
+func boolFromEnv(name string, target *bool) error {
+	value, exists := os.LookupEnv(name)
+	if !exists {
+		return nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("invalid value for %s: %v", name, value)
+	}
+	*target = parsed
+	return nil
+}
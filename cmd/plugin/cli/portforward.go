@@ -0,0 +1,32 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/fenio/pv-mounter/pkg/plugin"
+	"github.com/spf13/cobra"
+)
+
+// portForwardCmd is the background process started by mount to keep the
+// tunnel to the exposer pod open. It isn't meant to be run by hand.
+func portForwardCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:          "port-forward pod/<pod-name>",
+		Short:        "Forward a local port to a volume-exposer pod (internal)",
+		Hidden:       true,
+		SilenceUsage: true,
+		Args:         cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			// Mount hands over the ready pipe as the first extra file
+			ready := os.NewFile(3, "ready")
+			return plugin.ServePortForward(ctx, os.Stdin, ready)
+		},
+	}
+	return cmd
+}
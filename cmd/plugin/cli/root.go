@@ -1,10 +1,12 @@
 package cli
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/fenio/pv-mounter/pkg/plugin"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
@@ -29,13 +31,39 @@ func init() {
 	}
 
 	rootCmd.AddCommand(mountCmd())
+	rootCmd.AddCommand(runCmd())
 	rootCmd.AddCommand(cleanCmd())
+	rootCmd.AddCommand(listCmd())
+	rootCmd.AddCommand(statusCmd())
+	rootCmd.AddCommand(gcCmd())
+	rootCmd.AddCommand(portForwardCmd())
 }
 
 func RootCmd() *cobra.Command {
 	return rootCmd
 }
 
+// namespaceFromArgs splits off the optional leading <namespace> argument.
+// When it is omitted, the namespace comes from --namespace or the active
+// kubeconfig context. Giving both the argument and a different --namespace
+// is an error.
+func namespaceFromArgs(args []string, required int) (string, []string, error) {
+	if len(args) > required {
+		if flag := KubernetesConfigFlags.Namespace; flag != nil && *flag != "" && *flag != args[0] {
+			return "", nil, fmt.Errorf("namespace %s conflicts with --namespace %s, give only one", args[0], *flag)
+		}
+		return args[0], args[1:], nil
+	}
+	namespace, err := plugin.ResolveNamespace(KubernetesConfigFlags)
+	if err != nil {
+		return "", nil, err
+	}
+	if namespace == "" {
+		return "", nil, fmt.Errorf("no namespace given and none set in the current context")
+	}
+	return namespace, args, nil
+}
+
 func InitAndExecute() {
 	KubernetesConfigFlags = genericclioptions.NewConfigFlags(true)
 	KubernetesConfigFlags.AddFlags(RootCmd().PersistentFlags())
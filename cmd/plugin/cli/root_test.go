@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+func TestNamespaceFromArgs(t *testing.T) {
+	tests := []struct {
+		name          string
+		flag          string
+		args          []string
+		wantNamespace string
+		wantArgs      string
+		wantErr       string
+	}{
+		{
+			name:          "argument",
+			args:          []string{"some-ns", "some-pvc", "/mnt"},
+			wantNamespace: "some-ns",
+			wantArgs:      "some-pvc /mnt",
+		},
+		{
+			name:          "flag",
+			flag:          "other-ns",
+			args:          []string{"some-pvc", "/mnt"},
+			wantNamespace: "other-ns",
+			wantArgs:      "some-pvc /mnt",
+		},
+		{
+			name:          "argument and the same flag",
+			flag:          "some-ns",
+			args:          []string{"some-ns", "some-pvc", "/mnt"},
+			wantNamespace: "some-ns",
+			wantArgs:      "some-pvc /mnt",
+		},
+		{
+			name:    "argument and a different flag",
+			flag:    "other-ns",
+			args:    []string{"some-ns", "some-pvc", "/mnt"},
+			wantErr: "conflicts with --namespace other-ns",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			KubernetesConfigFlags = genericclioptions.NewConfigFlags(false)
+			KubernetesConfigFlags.Namespace = &tt.flag
+			namespace, args, err := namespaceFromArgs(tt.args, 2)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Expected an error with %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("namespaceFromArgs returned an error: %v", err)
+			}
+			if namespace != tt.wantNamespace || strings.Join(args, " ") != tt.wantArgs {
+				t.Errorf("Expected %s and %q, got %s and %q", tt.wantNamespace, tt.wantArgs, namespace, strings.Join(args, " "))
+			}
+		})
+	}
+}
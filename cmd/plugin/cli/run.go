@@ -0,0 +1,65 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/fenio/pv-mounter/pkg/plugin"
+	"github.com/spf13/cobra"
+)
+
+func runCmd() *cobra.Command {
+	var opts plugin.MountOptions
+	var keyType string
+
+	cmd := &cobra.Command{
+		Use:     "run [--needs-root] [--read-only] [--sub-path <dir>] [--as-owner] [--inherit-identity] [--key-type <type>] [--ssh-agent] [--max-lifetime <duration>] [--debug] [<namespace>] <pvc-name> | pod/<name> | sts/<name> | deploy/<name> | job/<name> [--volume <name>] [--ordinal <n>] -- <command> [<args>...]",
+		Aliases: []string{"exec"},
+		Short:   "Run a local command against a PVC, then clean up",
+		Long: `Mount a PVC into a temporary directory and run <command> there.
+
+The command runs with the mount as its working directory, which is also in
+$` + plugin.MountDirEnv + `. Once it exits the mount is cleaned up and pv-mounter
+exits with the command's exit code.`,
+		Args: func(cmd *cobra.Command, args []string) error {
+			dash := cmd.ArgsLenAtDash()
+			if dash < 0 || dash == len(args) {
+				return fmt.Errorf("a command is required after --")
+			}
+			return cobra.RangeArgs(1, 2)(cmd, args[:dash])
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := resolveMountOptions(cmd, &opts, keyType); err != nil {
+				return err
+			}
+
+			dash := cmd.ArgsLenAtDash()
+			namespace, volumeArgs, err := namespaceFromArgs(args[:dash], 1)
+			if err != nil {
+				return err
+			}
+			pvcName := volumeArgs[0]
+
+			// A signal during the mount rolls it back, during the command it
+			// just reaches the command
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			code, err := plugin.Run(ctx, KubernetesConfigFlags, namespace, pvcName, args[dash:], opts)
+			if err != nil {
+				return fmt.Errorf("failed to run against PVC: %w", err)
+			}
+			if code != 0 {
+				stop()
+				os.Exit(code)
+			}
+			return nil
+		},
+	}
+
+	addMountFlags(cmd, &opts, &keyType)
+	return cmd
+}
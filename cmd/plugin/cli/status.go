@@ -0,0 +1,29 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/fenio/pv-mounter/pkg/plugin"
+	"github.com/spf13/cobra"
+)
+
+func statusCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "status <local-mount-point>",
+		Short: "Show the state and health of a mounted PVC",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			localMountPoint := args[0]
+
+			// Create a context
+			ctx := context.Background()
+
+			if err := plugin.Status(ctx, KubernetesConfigFlags, localMountPoint, cmd.OutOrStdout()); err != nil {
+				return fmt.Errorf("failed to get mount status: %w", err)
+			}
+			return nil
+		},
+	}
+	return cmd
+}
@@ -0,0 +1,55 @@
+#!/bin/bash
+# Sourced by entrypoint.sh and tunnel.sh. setup_session puts the keys of the
+# session into a private directory and prepares the sshd arguments.
+
+setup_session() {
+  if [ -z "${SSH_PORT}" ]; then
+    # Define the variable
+    SSH_PORT="2137"
+  fi
+
+  # Determine the user based on NEEDS_ROOT variable
+  if [ "${NEEDS_ROOT}" = "true" ]; then
+    SSH_USER="root"
+  else
+    SSH_USER="ve"
+  fi
+
+  # Keep the session files in a private directory. /proc/1/environ can't be used
+  # for the public key: with a shared process namespace PID 1 is the workload.
+  umask 077
+  SESSION_DIR=$(mktemp -d /dev/shm/pv-mounter.XXXXXX)
+  printf "%s\n" "$SSH_PUBLIC_KEY" > "$SESSION_DIR/authorized_keys"
+
+  # pv-mounter generates the host key for every session so the client can pin
+  # it. Images started without one fall back to the keys baked into the image,
+  # which are world-readable so any UID can copy them, but sshd only accepts
+  # private copies.
+  if [ -n "$SSH_HOST_KEY" ]; then
+    printf "%s\n" "$SSH_HOST_KEY" > "$SESSION_DIR/ssh_host_session_key"
+  else
+    for key in /etc/ssh/ssh_host_*_key; do
+      cp "$key" "$SESSION_DIR/"
+    done
+  fi
+
+  SSHD_ARGS=(-D -e -p "$SSH_PORT" -o "AuthorizedKeysCommand=/sshkey.sh $SESSION_DIR/authorized_keys")
+  for key in "$SESSION_DIR"/ssh_host_*_key; do
+    SSHD_ARGS+=(-h "$key")
+  done
+
+  # When running with a borrowed UID, map the ssh user to it with nss_wrapper so
+  # sshd and ssh find a passwd entry for the current process
+  if [ "$(id -u)" != "$(id -u "$SSH_USER")" ]; then
+    sed "s|^${SSH_USER}:x:[0-9]*:[0-9]*:\([^:]*\):[^:]*:|${SSH_USER}:x:$(id -u):$(id -g):\1:${SESSION_DIR}:|" /etc/passwd > "$SESSION_DIR/passwd"
+    cp /etc/group "$SESSION_DIR/group"
+    if ! getent group "$(id -g)" >/dev/null; then
+      echo "${SSH_USER}-$(id -g):x:$(id -g):" >> "$SESSION_DIR/group"
+    fi
+    chmod 644 "$SESSION_DIR/passwd" "$SESSION_DIR/group"
+    export LD_PRELOAD=libnss_wrapper.so
+    export NSS_WRAPPER_PASSWD="$SESSION_DIR/passwd"
+    export NSS_WRAPPER_GROUP="$SESSION_DIR/group"
+    echo "Running as $(id -u):$(id -g) mapped to ${SSH_USER}"
+  fi
+}
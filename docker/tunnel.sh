@@ -0,0 +1,134 @@
+#!/bin/bash
+# Runs sshd and the reverse tunnel to the proxy pod inside an ephemeral
+# container. The entrypoint starts the first session from the container
+# environment. When pv-mounter reuses a running container it starts the next
+# session over exec instead, passing it on stdin as NAME=<base64> lines, and
+# stops it again on clean while the container itself keeps running. The
+# container stops by itself MAX_LIFETIME seconds after the latest session
+# started, or once no tunnel has run for IDLE_TIMEOUT seconds.
+
+. /session.sh
+
+POINTER="/dev/shm/pv-mounter-${CONTAINER_NAME:-volume-exposer-ephemeral}.session"
+DEADLINE="/dev/shm/pv-mounter-${CONTAINER_NAME:-volume-exposer-ephemeral}.deadline"
+
+# spawn runs a command detached from this script and records its PID, so the
+# session survives the exec that started it
+spawn() {
+  local name=$1
+  shift
+  setsid -f bash -c 'echo $$ > "$0"; exec "$@"' "$SESSION_DIR/$name.pid" "$@"
+}
+
+stop() {
+  if [ ! -f "$POINTER" ]; then
+    return 0
+  fi
+  local dir
+  dir=$(cat "$POINTER")
+  for pidfile in "$dir"/*.pid; do
+    if [ -f "$pidfile" ]; then
+      kill "$(cat "$pidfile")" 2>/dev/null
+    fi
+  done
+  rm -rf "$dir" "$POINTER"
+  echo "Tunnel stopped"
+}
+
+# set_deadline makes the keepalive stop MAX_LIFETIME seconds from now, or
+# never without a lifetime
+set_deadline() {
+  if [ -n "$MAX_LIFETIME" ]; then
+    echo $(( $(date +%s) + MAX_LIFETIME )) > "$DEADLINE"
+  else
+    rm -f "$DEADLINE"
+  fi
+}
+
+# tunnel_running tells whether a session's tunnel is up, which is what keeps
+# the container from being idle
+tunnel_running() {
+  [ -f "$POINTER" ] && kill -0 "$(cat "$(cat "$POINTER")/tunnel.pid" 2>/dev/null)" 2>/dev/null
+}
+
+# keepalive keeps the container running until the deadline passes or it has
+# been idle for too long. It may be PID 1 of the container, which ignores
+# signals without a handler.
+keepalive() {
+  trap 'exit 0' TERM
+  local now idle_since=""
+  while true; do
+    now=$(date +%s)
+    if [ -f "$DEADLINE" ] && [ "$now" -ge "$(cat "$DEADLINE")" ]; then
+      echo "Lifetime of ${MAX_LIFETIME}s is over"
+      return
+    fi
+    if tunnel_running; then
+      idle_since=""
+    elif [ -z "$idle_since" ]; then
+      idle_since=$now
+    elif [ -n "$IDLE_TIMEOUT" ] && [ $(( now - idle_since )) -ge "$IDLE_TIMEOUT" ]; then
+      echo "Idle for ${IDLE_TIMEOUT}s, nobody reused the container"
+      return
+    fi
+    sleep 5 &
+    wait $!
+  done
+}
+
+start() {
+  if [ "$1" = "--stdin" ]; then
+    while IFS='=' read -r name value; do
+      case "$name" in
+        SSH_PUBLIC_KEY|SSH_PRIVATE_KEY|SSH_HOST_KEY|SSH_HOST_PUBLIC_KEY|PROXY_POD_IP|MAX_LIFETIME)
+          export "$name=$(printf "%s" "$value" | base64 -d)"
+          ;;
+      esac
+    done
+  fi
+
+  stop
+  set_deadline
+  setup_session
+  echo "$SESSION_DIR" > "$POINTER"
+  if [ "$1" = "--stdin" ]; then
+    # Nothing may hold on to the exec streams once this script returns
+    exec >>"$SESSION_DIR/tunnel.log" 2>&1 </dev/null
+  fi
+
+  spawn sshd /usr/sbin/sshd "${SSHD_ARGS[@]}"
+  export SSH_AUTH_SOCK="$SESSION_DIR/ssh-agent.sock"
+  spawn ssh-agent ssh-agent -D -a "$SSH_AUTH_SOCK"
+  for _ in $(seq 50); do
+    [ -S "$SSH_AUTH_SOCK" ] && break
+    sleep 0.1
+  done
+  ssh-add <(printf "%s\n" "$SSH_PRIVATE_KEY") || return 1
+  # The proxy pod serves the same session host key, pin it for the tunnel
+  printf "volume-exposer-proxy %s\n" "$SSH_HOST_PUBLIC_KEY" > "$SESSION_DIR/known_hosts"
+  spawn tunnel ssh -o StrictHostKeyChecking=yes -o UserKnownHostsFile="$SESSION_DIR/known_hosts" -o HostKeyAlias=volume-exposer-proxy \
+    -o ExitOnForwardFailure=yes -o ServerAliveInterval=30 -N -R 2137:localhost:2137 "${SSH_USER}@${PROXY_POD_IP}" -p 6666
+  echo "Tunnel to ${PROXY_POD_IP} started"
+}
+
+case "$1" in
+  start)
+    shift
+    start "$@"
+    ;;
+  stop)
+    stop
+    ;;
+  keepalive)
+    keepalive
+    ;;
+  logs)
+    if [ -f "$POINTER" ]; then
+      cat "$(cat "$POINTER")/tunnel.log" 2>/dev/null
+    fi
+    ;;
+  *)
+    echo "Usage: $0 start [--stdin] | stop | keepalive | logs" >&2
+    exit 2
+    ;;
+esac
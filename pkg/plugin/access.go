@@ -0,0 +1,395 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+)
+
+// mountStrategy is how the volume gets exposed over SSH.
+type mountStrategy int
+
+const (
+	// strategyStandalone mounts the PVC in a new volume-exposer pod.
+	strategyStandalone mountStrategy = iota
+	// strategyEphemeral injects an ephemeral container into the pod that
+	// already uses the volume and tunnels to it through a proxy pod.
+	strategyEphemeral
+)
+
+// accessPlan is the outcome of checkPVAccessMode.
+type accessPlan struct {
+	strategy mountStrategy
+	// podUsingPVC is the pod currently using the volume, if any.
+	podUsingPVC string
+	// nodeName pins the standalone pod next to podUsingPVC.
+	nodeName string
+	// readOnly forces a read-only mount.
+	readOnly bool
+	// reason explains the decision to the user.
+	reason string
+}
+
+// checkPVAccessMode works out how the PVC can be mounted before anything is
+// created in the cluster. targetPod is the pod picked with --target-pod and
+// resolvedPod the one a pod/<name> target resolved to; either names the pod
+// to treat as the one using the volume.
+func checkPVAccessMode(ctx context.Context, clientset *kubernetes.Clientset, pvc *corev1.PersistentVolumeClaim, namespace, targetPod, resolvedPod string) (accessPlan, error) {
+	pvName := pvc.Spec.VolumeName
+	pv, err := clientset.CoreV1().PersistentVolumes().Get(ctx, pvName, metav1.GetOptions{})
+	if err != nil {
+		return accessPlan{}, fmt.Errorf("failed to get PV: %v", err)
+	}
+
+	mode, err := effectiveAccessMode(pvc, pv)
+	if err != nil {
+		return accessPlan{}, err
+	}
+
+	var podUsingPVC *corev1.Pod
+	if mode == corev1.ReadWriteOnce || mode == corev1.ReadWriteOncePod {
+		pinned := targetPod
+		if resolvedPod != "" {
+			pinned = resolvedPod
+		}
+		candidates, err := findPodsUsingPVC(ctx, clientset, namespace, pvc.Name, pv, pinned)
+		if err != nil {
+			return accessPlan{}, err
+		}
+		var choice string
+		podUsingPVC, choice, err = choosePodUsingPVC(pvc.Name, candidates, pinned)
+		if err != nil {
+			return accessPlan{}, err
+		}
+		if choice != "" {
+			fmt.Println(choice)
+		}
+	} else if targetPod != "" {
+		fmt.Printf("Warning: --target-pod has no effect, PVC %s is %s\n", pvc.Name, mode)
+	}
+
+	return planAccess(pvc.Name, mode, podUsingPVC)
+}
+
+// effectiveAccessMode picks the access mode that governs how the volume can
+// be shared. ReadWriteOncePod is enforced on the claim, the others by the
+// attach/detach logic on the volume, so they're read from the PV.
+func effectiveAccessMode(pvc *corev1.PersistentVolumeClaim, pv *corev1.PersistentVolume) (corev1.PersistentVolumeAccessMode, error) {
+	if contains(pvc.Spec.AccessModes, corev1.ReadWriteOncePod) {
+		return corev1.ReadWriteOncePod, nil
+	}
+	for _, mode := range []corev1.PersistentVolumeAccessMode{
+		corev1.ReadWriteMany,
+		corev1.ReadWriteOnce,
+		corev1.ReadOnlyMany,
+		corev1.ReadWriteOncePod,
+	} {
+		if contains(pv.Spec.AccessModes, mode) {
+			return mode, nil
+		}
+	}
+	return "", fmt.Errorf("PV %s has no supported access mode", pv.Name)
+}
+
+// planAccess is the decision table for mounting a volume:
+//
+//	mode  idle                 in use, pod running              in use, pod not running
+//	RWX   standalone           standalone                       standalone
+//	ROX   standalone, ro       standalone, ro                   standalone, ro
+//	RWO   standalone           standalone on the pod's node     error unless scheduled
+//	RWOP  standalone           ephemeral container              error
+func planAccess(pvcName string, mode corev1.PersistentVolumeAccessMode, podUsingPVC *corev1.Pod) (accessPlan, error) {
+	switch mode {
+	case corev1.ReadWriteMany:
+		return accessPlan{
+			strategy: strategyStandalone,
+			reason:   fmt.Sprintf("PVC %s is ReadWriteMany, mounting it in a standalone pod", pvcName),
+		}, nil
+
+	case corev1.ReadOnlyMany:
+		return accessPlan{
+			strategy: strategyStandalone,
+			readOnly: true,
+			reason:   fmt.Sprintf("PVC %s is ReadOnlyMany, mounting it read-only in a standalone pod", pvcName),
+		}, nil
+
+	case corev1.ReadWriteOnce:
+		if podUsingPVC == nil {
+			return accessPlan{
+				strategy: strategyStandalone,
+				reason:   fmt.Sprintf("PVC %s is ReadWriteOnce and not in use, mounting it in a standalone pod", pvcName),
+			}, nil
+		}
+		// RWO only prevents attaching the volume to more than one node
+		if podUsingPVC.Spec.NodeName == "" {
+			return accessPlan{}, fmt.Errorf("PVC %s is ReadWriteOnce and used by pod %s, which isn't scheduled yet; mounting it now could attach the volume to the wrong node", pvcName, podUsingPVC.Name)
+		}
+		return accessPlan{
+			strategy:    strategyStandalone,
+			podUsingPVC: podUsingPVC.Name,
+			nodeName:    podUsingPVC.Spec.NodeName,
+			reason:      fmt.Sprintf("PVC %s is ReadWriteOnce and used by pod %s, mounting it in a standalone pod on node %s", pvcName, podUsingPVC.Name, podUsingPVC.Spec.NodeName),
+		}, nil
+
+	case corev1.ReadWriteOncePod:
+		if podUsingPVC == nil {
+			return accessPlan{
+				strategy: strategyStandalone,
+				reason:   fmt.Sprintf("PVC %s is ReadWriteOncePod and not in use, mounting it in a standalone pod", pvcName),
+			}, nil
+		}
+		// No second pod may use the volume, so the only way in is through the pod itself
+		if podUsingPVC.Status.Phase != corev1.PodRunning {
+			return accessPlan{}, fmt.Errorf("PVC %s is ReadWriteOncePod and used by pod %s, which is %s; an ephemeral container can only be added to a running pod", pvcName, podUsingPVC.Name, podPhase(podUsingPVC))
+		}
+		return accessPlan{
+			strategy:    strategyEphemeral,
+			podUsingPVC: podUsingPVC.Name,
+			reason:      fmt.Sprintf("PVC %s is ReadWriteOncePod and used by pod %s, mounting it through an ephemeral container", pvcName, podUsingPVC.Name),
+		}, nil
+	}
+	return accessPlan{}, fmt.Errorf("unsupported access mode %s for PVC %s", mode, pvcName)
+}
+
+func podPhase(pod *corev1.Pod) string {
+	if pod.Status.Phase == "" {
+		return "not started"
+	}
+	return string(pod.Status.Phase)
+}
+
+// listPageSize is how many objects one list request returns at most.
+const listPageSize = 500
+
+// findPodsUsingPVC returns the pods in the namespace that reference the PVC.
+// Pods can't be selected by volume, so when the VolumeAttachments tell where
+// the volume is attached, only the pods on those nodes and the ones not
+// scheduled yet are listed. The rest of the namespace is only listed, in
+// pages, when the attachments can't tell, when the attached nodes have no
+// such pod, or when targetPod isn't among them.
+func findPodsUsingPVC(ctx context.Context, clientset kubernetes.Interface, namespace, pvcName string, pv *corev1.PersistentVolume, targetPod string) ([]corev1.Pod, error) {
+	nodes, known, err := attachedNodes(ctx, clientset, pv)
+	if err != nil {
+		fmt.Printf("Warning: %v, looking through the whole namespace\n", err)
+	}
+	if known {
+		var pods []corev1.Pod
+		for _, node := range append(nodes, "") {
+			found, err := findPodsUsingPVCWhere(ctx, clientset, namespace, pvcName, fields.OneTermEqualSelector("spec.nodeName", node).String())
+			if err != nil {
+				return nil, err
+			}
+			for _, pod := range found {
+				if !containsPod(pods, pod.Name) {
+					pods = append(pods, pod)
+				}
+			}
+		}
+		// A volume that isn't attached anywhere is held by no running pod
+		if (len(pods) > 0 || len(nodes) == 0) && (targetPod == "" || containsPod(pods, targetPod)) {
+			return pods, nil
+		}
+	}
+	return findPodsUsingPVCWhere(ctx, clientset, namespace, pvcName, "")
+}
+
+// findPodsUsingPVCWhere lists the pods matching fieldSelector page by page
+// and keeps the ones that reference the PVC.
+func findPodsUsingPVCWhere(ctx context.Context, clientset kubernetes.Interface, namespace, pvcName, fieldSelector string) ([]corev1.Pod, error) {
+	var pods []corev1.Pod
+	options := metav1.ListOptions{FieldSelector: fieldSelector, Limit: listPageSize}
+	for {
+		podList, err := clientset.CoreV1().Pods(namespace).List(ctx, options)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list pods: %v", err)
+		}
+		for _, pod := range podList.Items {
+			if _, ok := pvcVolume(&pod, pvcName); ok {
+				pods = append(pods, pod)
+			}
+		}
+		if podList.Continue == "" {
+			return pods, nil
+		}
+		options.Continue = podList.Continue
+	}
+}
+
+// pvcVolume returns the volume of pod that is backed by the PVC: one that
+// names the claim, or a generic ephemeral volume the claim was created for.
+func pvcVolume(pod *corev1.Pod, pvcName string) (string, bool) {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == pvcName {
+			return volume.Name, true
+		}
+		if volume.Ephemeral != nil && pod.Name+"-"+volume.Name == pvcName {
+			return volume.Name, true
+		}
+	}
+	return "", false
+}
+
+func containsPod(pods []corev1.Pod, name string) bool {
+	for _, pod := range pods {
+		if pod.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// podUsage ranks how surely pod holds its volumes right now, from 0 for
+// pods that don't at all, and says why.
+func podUsage(pod *corev1.Pod) (int, string) {
+	switch {
+	case pod.DeletionTimestamp != nil:
+		return 0, "is being deleted"
+	case pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed:
+		return 0, fmt.Sprintf("has finished (%s)", pod.Status.Phase)
+	case pod.Spec.NodeName == "":
+		return 1, "isn't scheduled yet"
+	case pod.Status.Phase != corev1.PodRunning:
+		return 2, fmt.Sprintf("is %s on node %s", podPhase(pod), pod.Spec.NodeName)
+	}
+	running := 0
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Running != nil {
+			running++
+		}
+	}
+	if total := len(pod.Spec.Containers); running < total {
+		return 3, fmt.Sprintf("is running on node %s with %d of %d containers up", pod.Spec.NodeName, running, total)
+	}
+	return 4, fmt.Sprintf("is running on node %s", pod.Spec.NodeName)
+}
+
+// rankPods sorts pods by podUsage, best first, and oldest first among
+// equals, as that's the one that got the volume.
+func rankPods(pods []corev1.Pod) []corev1.Pod {
+	sorted := append([]corev1.Pod{}, pods...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		rankI, _ := podUsage(&sorted[i])
+		rankJ, _ := podUsage(&sorted[j])
+		if rankI != rankJ {
+			return rankI > rankJ
+		}
+		return sorted[i].CreationTimestamp.Before(&sorted[j].CreationTimestamp)
+	})
+	return sorted
+}
+
+// choosePodUsingPVC picks the pod that holds the volume among the pods that
+// reference it, or targetPod when set, and explains the choice. It returns
+// nil when none of them holds it.
+func choosePodUsingPVC(pvcName string, candidates []corev1.Pod, targetPod string) (*corev1.Pod, string, error) {
+	if targetPod != "" {
+		for i := range candidates {
+			if candidates[i].Name == targetPod {
+				_, usage := podUsage(&candidates[i])
+				return &candidates[i], fmt.Sprintf("Using pod %s for PVC %s as asked, it %s", targetPod, pvcName, usage), nil
+			}
+		}
+		return nil, "", fmt.Errorf("pod %s doesn't use PVC %s%s", targetPod, pvcName, describeCandidates(candidates, nil))
+	}
+	if len(candidates) == 0 {
+		return nil, "", nil
+	}
+
+	sorted := rankPods(candidates)
+	chosen := &sorted[0]
+	rank, usage := podUsage(chosen)
+	if rank == 0 {
+		return nil, fmt.Sprintf("PVC %s is only referenced by pods that don't hold it:%s", pvcName, describeCandidates(sorted, nil)), nil
+	}
+
+	choice := fmt.Sprintf("Pod %s uses PVC %s, it %s", chosen.Name, pvcName, usage)
+	if len(sorted) > 1 {
+		choice += "\nAlso referenced by:" + describeCandidates(sorted, chosen)
+		if next, _ := podUsage(&sorted[1]); next == rank {
+			choice += "\nPick another one with --target-pod"
+		}
+	}
+	return chosen, choice, nil
+}
+
+// describeCandidates lists the pods other than skip, with what they're doing.
+func describeCandidates(pods []corev1.Pod, skip *corev1.Pod) string {
+	var b strings.Builder
+	for i := range pods {
+		if skip != nil && pods[i].Name == skip.Name {
+			continue
+		}
+		_, usage := podUsage(&pods[i])
+		fmt.Fprintf(&b, "\n  %s %s", pods[i].Name, usage)
+	}
+	return b.String()
+}
+
+// attachedNodes returns the nodes the PV is attached to, as far as its
+// VolumeAttachments tell, and whether they can tell at all. Only CSI volumes
+// whose driver needs attaching have those, and reading them takes
+// cluster-wide permission, so without either the namespace is searched
+// instead.
+func attachedNodes(ctx context.Context, clientset kubernetes.Interface, pv *corev1.PersistentVolume) ([]string, bool, error) {
+	if pv.Spec.CSI == nil {
+		return nil, false, nil
+	}
+	// Drivers without a CSIDriver object need attaching
+	driver, err := clientset.StorageV1().CSIDrivers().Get(ctx, pv.Spec.CSI.Driver, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+	case apierrors.IsForbidden(err):
+		return nil, false, nil
+	case err != nil:
+		return nil, false, fmt.Errorf("failed to get CSI driver: %v", err)
+	case driver.Spec.AttachRequired != nil && !*driver.Spec.AttachRequired:
+		return nil, false, nil
+	}
+
+	// Ask for the PV's attachments only; servers that can't select them by
+	// source reject that, and then every attachment is looked at
+	var nodes []string
+	options := metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.source.persistentVolumeName", pv.Name).String(),
+		Limit:         listPageSize,
+	}
+	for {
+		attachments, err := clientset.StorageV1().VolumeAttachments().List(ctx, options)
+		switch {
+		case apierrors.IsBadRequest(err) && options.FieldSelector != "":
+			nodes = nil
+			options = metav1.ListOptions{Limit: listPageSize}
+			continue
+		case apierrors.IsForbidden(err):
+			return nil, false, nil
+		case err != nil:
+			return nil, false, fmt.Errorf("failed to list volume attachments: %v", err)
+		}
+		for _, attachment := range attachments.Items {
+			source := attachment.Spec.Source.PersistentVolumeName
+			if source != nil && *source == pv.Name && attachment.Status.Attached {
+				nodes = append(nodes, attachment.Spec.NodeName)
+			}
+		}
+		if attachments.Continue == "" {
+			return nodes, true, nil
+		}
+		options.Continue = attachments.Continue
+	}
+}
+
+func contains(modes []corev1.PersistentVolumeAccessMode, modeToFind corev1.PersistentVolumeAccessMode) bool {
+	for _, mode := range modes {
+		if mode == modeToFind {
+			return true
+		}
+	}
+	return false
+}
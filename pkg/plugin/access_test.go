@@ -0,0 +1,518 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestPlanAccess(t *testing.T) {
+	tests := []struct {
+		name         string
+		mode         corev1.PersistentVolumeAccessMode
+		pod          *corev1.Pod
+		wantErr      bool
+		wantStrategy mountStrategy
+		wantNode     string
+		wantReadOnly bool
+	}{
+		{name: "RWX idle", mode: corev1.ReadWriteMany, wantStrategy: strategyStandalone},
+		{name: "RWX in use", mode: corev1.ReadWriteMany, pod: testPod("web-0", onNode("node-1"), inPhase(corev1.PodRunning)), wantStrategy: strategyStandalone},
+		{name: "ROX idle", mode: corev1.ReadOnlyMany, wantStrategy: strategyStandalone, wantReadOnly: true},
+		{name: "ROX in use", mode: corev1.ReadOnlyMany, pod: testPod("web-0", onNode("node-1"), inPhase(corev1.PodRunning)), wantStrategy: strategyStandalone, wantReadOnly: true},
+		{name: "RWO idle", mode: corev1.ReadWriteOnce, wantStrategy: strategyStandalone},
+		{name: "RWO in use", mode: corev1.ReadWriteOnce, pod: testPod("web-0", onNode("node-1"), inPhase(corev1.PodRunning)), wantStrategy: strategyStandalone, wantNode: "node-1"},
+		{name: "RWO in use, pending on a node", mode: corev1.ReadWriteOnce, pod: testPod("web-0", onNode("node-1"), inPhase(corev1.PodPending)), wantStrategy: strategyStandalone, wantNode: "node-1"},
+		{name: "RWO in use, not scheduled", mode: corev1.ReadWriteOnce, pod: testPod("web-0", onNode(""), inPhase(corev1.PodPending)), wantErr: true},
+		{name: "RWOP idle", mode: corev1.ReadWriteOncePod, wantStrategy: strategyStandalone},
+		{name: "RWOP in use", mode: corev1.ReadWriteOncePod, pod: testPod("web-0", onNode("node-1"), inPhase(corev1.PodRunning)), wantStrategy: strategyEphemeral},
+		{name: "RWOP in use, pod pending", mode: corev1.ReadWriteOncePod, pod: testPod("web-0", onNode("node-1"), inPhase(corev1.PodPending)), wantErr: true},
+		{name: "Unknown mode", mode: "Bogus", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := planAccess("pvc", tt.mode, tt.pod)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("planAccess should have returned an error, got %+v", plan)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("planAccess returned an error: %v", err)
+			}
+			if plan.strategy != tt.wantStrategy {
+				t.Errorf("Expected strategy %v, got %v", tt.wantStrategy, plan.strategy)
+			}
+			if plan.nodeName != tt.wantNode {
+				t.Errorf("Expected node %q, got %q", tt.wantNode, plan.nodeName)
+			}
+			if plan.readOnly != tt.wantReadOnly {
+				t.Errorf("Expected readOnly %v, got %v", tt.wantReadOnly, plan.readOnly)
+			}
+			if plan.reason == "" {
+				t.Error("Expected a reason for the decision")
+			}
+		})
+	}
+}
+
+func TestEffectiveAccessMode(t *testing.T) {
+	tests := []struct {
+		name     string
+		pvcModes []corev1.PersistentVolumeAccessMode
+		pvModes  []corev1.PersistentVolumeAccessMode
+		want     corev1.PersistentVolumeAccessMode
+		wantErr  bool
+	}{
+		{name: "RWX wins", pvModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce, corev1.ReadWriteMany}, want: corev1.ReadWriteMany},
+		{name: "RWO over ROX", pvModes: []corev1.PersistentVolumeAccessMode{corev1.ReadOnlyMany, corev1.ReadWriteOnce}, want: corev1.ReadWriteOnce},
+		{name: "ROX only", pvModes: []corev1.PersistentVolumeAccessMode{corev1.ReadOnlyMany}, want: corev1.ReadOnlyMany},
+		{name: "RWOP requested by the claim", pvcModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOncePod}, pvModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce, corev1.ReadWriteOncePod}, want: corev1.ReadWriteOncePod},
+		{name: "RWOP only volume", pvModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOncePod}, want: corev1.ReadWriteOncePod},
+		{name: "No modes", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{Spec: corev1.PersistentVolumeClaimSpec{AccessModes: tt.pvcModes}}
+			pv := &corev1.PersistentVolume{Spec: corev1.PersistentVolumeSpec{AccessModes: tt.pvModes}}
+			got, err := effectiveAccessMode(pvc, pv)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("effectiveAccessMode should have returned an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("effectiveAccessMode returned an error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestFindPodUsingPVC(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"}},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-0", Namespace: "default"},
+			Spec: corev1.PodSpec{
+				Volumes: []corev1.Volume{
+					{
+						Name: "data",
+						VolumeSource: corev1.VolumeSource{
+							PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data-web-0"},
+						},
+					},
+				},
+			},
+		},
+	)
+
+	pods, err := findPodsUsingPVC(context.Background(), clientset, "default", "data-web-0", csiVolume("pv-1"), "")
+	if err != nil {
+		t.Fatalf("findPodsUsingPVC returned an error: %v", err)
+	}
+	if got := podNames(pods); got != "web-0" {
+		t.Errorf("Expected pod web-0, got %q", got)
+	}
+
+	pods, err = findPodsUsingPVC(context.Background(), clientset, "default", "unused", csiVolume("pv-2"), "")
+	if err != nil {
+		t.Fatalf("findPodsUsingPVC returned an error: %v", err)
+	}
+	if len(pods) != 0 {
+		t.Errorf("Expected no pod, got %q", podNames(pods))
+	}
+}
+
+func podNames(pods []corev1.Pod) string {
+	var names []string
+	for _, pod := range pods {
+		names = append(names, pod.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// servePodFieldSelectors makes the fake clientset honour field selectors on
+// pod lists like the API server does, and counts the pods it returns.
+func servePodFieldSelectors(clientset *fake.Clientset, served *int) {
+	clientset.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		selector := action.(k8stesting.ListAction).GetListRestrictions().Fields
+		obj, err := clientset.Tracker().List(corev1.SchemeGroupVersion.WithResource("pods"), corev1.SchemeGroupVersion.WithKind("Pod"), action.GetNamespace())
+		if err != nil {
+			return true, nil, err
+		}
+		list := &corev1.PodList{}
+		for _, pod := range obj.(*corev1.PodList).Items {
+			if selector == nil || selector.Matches(fields.Set{"metadata.name": pod.Name, "spec.nodeName": pod.Spec.NodeName}) {
+				list.Items = append(list.Items, pod)
+			}
+		}
+		*served += len(list.Items)
+		return true, list, nil
+	})
+}
+
+func csiVolume(name string) *corev1.PersistentVolume {
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{CSI: &corev1.CSIPersistentVolumeSource{Driver: "ebs.csi.aws.com"}},
+		},
+	}
+}
+
+func volumeAttachment(pvName, nodeName string) *storagev1.VolumeAttachment {
+	return &storagev1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "csi-" + pvName + "-" + nodeName},
+		Spec: storagev1.VolumeAttachmentSpec{
+			NodeName: nodeName,
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+		},
+		Status: storagev1.VolumeAttachmentStatus{Attached: true},
+	}
+}
+
+// busyNamespace holds pods pods spread over 50 nodes; the last one uses
+// data-web-0, whose volume pv-1 is attached to its node when attached is set.
+func busyNamespace(pods int, attached bool) []runtime.Object {
+	var objects []runtime.Object
+	for i := 0; i < pods-1; i++ {
+		objects = append(objects, testPod(fmt.Sprintf("app-%d", i), onNode(fmt.Sprintf("node-%d", i%50)), usingClaim(fmt.Sprintf("data-app-%d", i))))
+	}
+	objects = append(objects, testPod("web-0", onNode("node-7"), usingClaim("data-web-0")))
+	if attached {
+		objects = append(objects, volumeAttachment("pv-1", "node-7"))
+	}
+	return objects
+}
+
+func TestFindPodsUsingPVCOnAttachedNode(t *testing.T) {
+	ctx := context.Background()
+
+	var served int
+	clientset := fake.NewSimpleClientset(busyNamespace(1000, true)...)
+	servePodFieldSelectors(clientset, &served)
+	pods, err := findPodsUsingPVC(ctx, clientset, "default", "data-web-0", csiVolume("pv-1"), "")
+	if err != nil || podNames(pods) != "web-0" {
+		t.Fatalf("Expected pod web-0, got %q, %v", podNames(pods), err)
+	}
+	if served > 1000/50+1 {
+		t.Errorf("Expected only the pods on node-7 to be listed, got %d", served)
+	}
+
+	// A stale attachment mustn't hide the pod that uses the volume elsewhere
+	clientset = fake.NewSimpleClientset(testPod("web-0", onNode("node-2"), usingClaim("data-web-0")), volumeAttachment("pv-1", "node-7"))
+	servePodFieldSelectors(clientset, &served)
+	pods, err = findPodsUsingPVC(ctx, clientset, "default", "data-web-0", csiVolume("pv-1"), "")
+	if err != nil || podNames(pods) != "web-0" {
+		t.Fatalf("Expected pod web-0 through the fallback, got %q, %v", podNames(pods), err)
+	}
+
+	// Pods that aren't scheduled yet are found too
+	clientset = fake.NewSimpleClientset(testPod("web-0", onNode(""), usingClaim("data-web-0")), volumeAttachment("pv-1", "node-7"))
+	servePodFieldSelectors(clientset, &served)
+	pods, err = findPodsUsingPVC(ctx, clientset, "default", "data-web-0", csiVolume("pv-1"), "")
+	if err != nil || podNames(pods) != "web-0" {
+		t.Fatalf("Expected the unscheduled pod web-0, got %q, %v", podNames(pods), err)
+	}
+
+	// The target pod is looked for in the whole namespace when it's elsewhere
+	clientset = fake.NewSimpleClientset(testPod("web-0", onNode("node-7"), usingClaim("data-web-0")), testPod("web-1", onNode("node-2"), usingClaim("data-web-0")), volumeAttachment("pv-1", "node-7"))
+	servePodFieldSelectors(clientset, &served)
+	pods, err = findPodsUsingPVC(ctx, clientset, "default", "data-web-0", csiVolume("pv-1"), "web-1")
+	if err != nil || podNames(pods) != "web-0,web-1" {
+		t.Fatalf("Expected both pods, got %q, %v", podNames(pods), err)
+	}
+}
+
+func TestFindPodsUsingPVCWithoutAttachments(t *testing.T) {
+	ctx := context.Background()
+	listsAttachments := func(clientset *fake.Clientset) bool {
+		for _, action := range clientset.Actions() {
+			if action.GetVerb() == "list" && action.GetResource().Resource == "volumeattachments" {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Only CSI volumes have VolumeAttachments, others don't look for them
+	nfs := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{NFS: &corev1.NFSVolumeSource{Server: "nfs", Path: "/"}},
+		},
+	}
+	clientset := fake.NewSimpleClientset(testPod("web-0", onNode("node-7"), usingClaim("data-web-0")), volumeAttachment("pv-1", "node-7"))
+	pods, err := findPodsUsingPVC(ctx, clientset, "default", "data-web-0", nfs, "")
+	if err != nil || podNames(pods) != "web-0" {
+		t.Fatalf("Expected pod web-0, got %q, %v", podNames(pods), err)
+	}
+	if listsAttachments(clientset) {
+		t.Error("Expected no VolumeAttachments to be listed for a non-CSI volume")
+	}
+
+	// Users limited to their namespace can't read them
+	clientset = fake.NewSimpleClientset(testPod("web-0", onNode("node-7"), usingClaim("data-web-0")))
+	clientset.PrependReactor("list", "volumeattachments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(storagev1.Resource("volumeattachments"), "", errors.New("cluster-scoped"))
+	})
+	pods, err = findPodsUsingPVC(ctx, clientset, "default", "data-web-0", csiVolume("pv-1"), "")
+	if err != nil || podNames(pods) != "web-0" {
+		t.Fatalf("Expected pod web-0 from the namespace, got %q, %v", podNames(pods), err)
+	}
+
+	// Attachments are listed in pages. The fake drops the list options, so
+	// the pages are told apart by count
+	clientset = fake.NewSimpleClientset()
+	var pages int
+	clientset.PrependReactor("list", "volumeattachments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pages++
+		switch pages {
+		case 1:
+			return true, &storagev1.VolumeAttachmentList{ListMeta: metav1.ListMeta{Continue: "page-2"}, Items: []storagev1.VolumeAttachment{*volumeAttachment("pv-2", "node-1")}}, nil
+		case 2:
+			return true, &storagev1.VolumeAttachmentList{Items: []storagev1.VolumeAttachment{*volumeAttachment("pv-1", "node-7")}}, nil
+		}
+		return true, nil, errors.New("listed past the last page")
+	})
+	nodes, known, err := attachedNodes(ctx, clientset, csiVolume("pv-1"))
+	if err != nil || !known || strings.Join(nodes, ",") != "node-7" {
+		t.Errorf("Expected node-7 from the second page, got %v, %v, %v", nodes, known, err)
+	}
+
+	// Drivers that don't attach have no VolumeAttachments to go by
+	attachRequired := false
+	clientset = fake.NewSimpleClientset(
+		testPod("web-0", onNode("node-7"), usingClaim("data-web-0")),
+		&storagev1.CSIDriver{ObjectMeta: metav1.ObjectMeta{Name: "ebs.csi.aws.com"}, Spec: storagev1.CSIDriverSpec{AttachRequired: &attachRequired}},
+	)
+	pods, err = findPodsUsingPVC(ctx, clientset, "default", "data-web-0", csiVolume("pv-1"), "")
+	if err != nil || podNames(pods) != "web-0" {
+		t.Fatalf("Expected pod web-0 from the namespace, got %q, %v", podNames(pods), err)
+	}
+	if listsAttachments(clientset) {
+		t.Error("Expected no VolumeAttachments to be listed for a driver that doesn't attach")
+	}
+}
+
+func TestAttachedNodesSelectsBySource(t *testing.T) {
+	ctx := context.Background()
+
+	var selectors []string
+	clientset := fake.NewSimpleClientset(volumeAttachment("pv-1", "node-7"), volumeAttachment("pv-2", "node-1"))
+	clientset.PrependReactor("list", "volumeattachments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		selectors = append(selectors, action.(k8stesting.ListAction).GetListRestrictions().Fields.String())
+		return false, nil, nil
+	})
+	nodes, known, err := attachedNodes(ctx, clientset, csiVolume("pv-1"))
+	if err != nil || !known || strings.Join(nodes, ",") != "node-7" {
+		t.Fatalf("Expected node-7, got %v, %v, %v", nodes, known, err)
+	}
+	if strings.Join(selectors, ";") != "spec.source.persistentVolumeName=pv-1" {
+		t.Errorf("Expected the attachments to be selected by PV, got %q", selectors)
+	}
+
+	// Servers that can't select by source get a plain list instead
+	selectors = nil
+	clientset = fake.NewSimpleClientset(volumeAttachment("pv-1", "node-7"), volumeAttachment("pv-2", "node-1"))
+	clientset.PrependReactor("list", "volumeattachments", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		selector := action.(k8stesting.ListAction).GetListRestrictions().Fields.String()
+		selectors = append(selectors, selector)
+		if selector != "" {
+			return true, nil, apierrors.NewBadRequest(`field label not supported: spec.source.persistentVolumeName`)
+		}
+		return false, nil, nil
+	})
+	nodes, known, err = attachedNodes(ctx, clientset, csiVolume("pv-1"))
+	if err != nil || !known || strings.Join(nodes, ",") != "node-7" {
+		t.Fatalf("Expected node-7 from the plain list, got %v, %v, %v", nodes, known, err)
+	}
+	if len(selectors) != 2 || selectors[1] != "" {
+		t.Errorf("Expected a plain list after the rejected selector, got %q", selectors)
+	}
+}
+
+func TestFindPodsUsingPVCNotAttached(t *testing.T) {
+	ctx := context.Background()
+
+	// Attachments say the volume is attached nowhere, so only the pods not
+	// scheduled yet may be on their way to use it
+	var served int
+	clientset := fake.NewSimpleClientset(testPod("web-0", onNode("node-7"), usingClaim("data-web-0")), testPod("web-1", onNode(""), usingClaim("data-web-0")))
+	servePodFieldSelectors(clientset, &served)
+	pods, err := findPodsUsingPVC(ctx, clientset, "default", "data-web-0", csiVolume("pv-1"), "")
+	if err != nil || podNames(pods) != "web-1" {
+		t.Fatalf("Expected only the unscheduled pod web-1, got %q, %v", podNames(pods), err)
+	}
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "list" && action.GetResource().Resource == "pods" && action.(k8stesting.ListAction).GetListRestrictions().Fields.Empty() {
+			t.Error("Expected the namespace not to be listed for a volume that isn't attached")
+		}
+	}
+
+	// The target pod is still looked for in the whole namespace
+	clientset = fake.NewSimpleClientset(testPod("web-0", onNode("node-7"), usingClaim("data-web-0")))
+	servePodFieldSelectors(clientset, &served)
+	pods, err = findPodsUsingPVC(ctx, clientset, "default", "data-web-0", csiVolume("pv-1"), "web-0")
+	if err != nil || podNames(pods) != "web-0" {
+		t.Fatalf("Expected the target pod web-0, got %q, %v", podNames(pods), err)
+	}
+}
+
+func BenchmarkFindPodsUsingPVC(b *testing.B) {
+	nfs := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{NFS: &corev1.NFSVolumeSource{Server: "nfs", Path: "/"}},
+		},
+	}
+	for _, bench := range []struct {
+		name     string
+		attached bool
+		pv       *corev1.PersistentVolume
+	}{
+		{name: "attached", attached: true, pv: csiVolume("pv-1")},
+		{name: "not attached", attached: false, pv: csiVolume("pv-1")},
+		{name: "namespace", attached: false, pv: nfs},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			var served int
+			clientset := fake.NewSimpleClientset(busyNamespace(5000, bench.attached)...)
+			servePodFieldSelectors(clientset, &served)
+			ctx := context.Background()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := findPodsUsingPVC(ctx, clientset, "default", "data-web-0", bench.pv, ""); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(served)/float64(b.N), "pods/op")
+		})
+	}
+}
+
+func TestPVCVolume(t *testing.T) {
+	pod := testPod("web-0", onNode("node-1"), usingClaim("logs-web-0"))
+	pod.Spec.Volumes = append(pod.Spec.Volumes,
+		corev1.Volume{Name: "cache", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+		corev1.Volume{Name: "scratch", VolumeSource: corev1.VolumeSource{Ephemeral: &corev1.EphemeralVolumeSource{}}},
+	)
+	for claim, want := range map[string]string{"logs-web-0": "data", "web-0-scratch": "scratch", "web-0-cache": ""} {
+		got, ok := pvcVolume(pod, claim)
+		if got != want || ok != (want != "") {
+			t.Errorf("pvcVolume(%q) = %q, %v, want %q", claim, got, ok, want)
+		}
+	}
+}
+
+func TestChoosePodUsingPVC(t *testing.T) {
+	at := func(minutes int) metav1.Time {
+		return metav1.NewTime(metav1.Now().Add(time.Duration(minutes) * time.Minute))
+	}
+	candidate := func(name, nodeName string, phase corev1.PodPhase, created metav1.Time, running int) corev1.Pod {
+		pod := *testPod(name, onNode(nodeName), usingClaim("data"))
+		pod.CreationTimestamp = created
+		pod.Status.Phase = phase
+		pod.Spec.Containers = []corev1.Container{{Name: "app"}, {Name: "sidecar"}}
+		for i := 0; i < running; i++ {
+			pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses, corev1.ContainerStatus{State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}})
+		}
+		return pod
+	}
+	deleting := candidate("old", "node-1", corev1.PodRunning, at(-60), 2)
+	deletedAt := at(-1)
+	deleting.DeletionTimestamp = &deletedAt
+
+	tests := []struct {
+		name       string
+		candidates []corev1.Pod
+		targetPod  string
+		want       string
+		wantChoice []string
+		wantErr    bool
+	}{
+		{name: "nobody"},
+		{
+			name:       "running beats finished and pending",
+			candidates: []corev1.Pod{candidate("job", "node-1", corev1.PodSucceeded, at(-30), 0), candidate("new", "node-2", corev1.PodPending, at(-1), 0), candidate("web", "node-1", corev1.PodRunning, at(-10), 2)},
+			want:       "web",
+			wantChoice: []string{"is running on node node-1", "job has finished (Succeeded)", "new is Pending on node node-2"},
+		},
+		{
+			name:       "a pod being deleted doesn't count",
+			candidates: []corev1.Pod{deleting, candidate("web", "node-2", corev1.PodRunning, at(-1), 1)},
+			want:       "web",
+			wantChoice: []string{"1 of 2 containers up", "old is being deleted"},
+		},
+		{
+			name:       "only finished pods",
+			candidates: []corev1.Pod{candidate("job", "node-1", corev1.PodFailed, at(-30), 0)},
+			wantChoice: []string{"don't hold it", "has finished (Failed)"},
+		},
+		{
+			name:       "oldest of equals, with a hint",
+			candidates: []corev1.Pod{candidate("web-b", "node-1", corev1.PodRunning, at(-5), 2), candidate("web-a", "node-1", corev1.PodRunning, at(-50), 2)},
+			want:       "web-a",
+			wantChoice: []string{"--target-pod"},
+		},
+		{
+			name:       "target pod",
+			candidates: []corev1.Pod{candidate("web-a", "node-1", corev1.PodRunning, at(-50), 2), candidate("web-b", "node-1", corev1.PodPending, at(-5), 0)},
+			targetPod:  "web-b",
+			want:       "web-b",
+			wantChoice: []string{"as asked", "Pending"},
+		},
+		{
+			name:       "target pod that doesn't use the PVC",
+			candidates: []corev1.Pod{candidate("web-a", "node-1", corev1.PodRunning, at(-50), 2)},
+			targetPod:  "web-c",
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod, choice, err := choosePodUsingPVC("data", tt.candidates, tt.targetPod)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got %v", pod)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("choosePodUsingPVC returned an error: %v", err)
+			}
+			got := ""
+			if pod != nil {
+				got = pod.Name
+			}
+			if got != tt.want {
+				t.Errorf("Expected pod %q, got %q", tt.want, got)
+			}
+			for _, want := range tt.wantChoice {
+				if !strings.Contains(choice, want) {
+					t.Errorf("Expected %q in %q", want, choice)
+				}
+			}
+		})
+	}
+}
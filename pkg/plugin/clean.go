@@ -3,15 +3,170 @@ package plugin
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
-func Clean(ctx context.Context, namespace, pvcName, localMountPoint string) error {
+// Clean tears down the mount session at localMountPoint. The session is
+// looked up in the local state first; if this machine has no record of it,
+// the pods' annotations are searched in namespace instead, optionally
+// narrowed down to pvcName.
+func Clean(ctx context.Context, configFlags *genericclioptions.ConfigFlags, namespace, pvcName, localMountPoint string) error {
+	mountPoint, err := absMountPoint(localMountPoint)
+	if err != nil {
+		return err
+	}
+
+	state, err := findMountState(mountPoint)
+	if err != nil {
+		return err
+	}
+	if state != nil {
+		configFlags = configFlagsForContext(configFlags, state.Context)
+	}
+
+	// Build Kubernetes client
+	clientset, restConfig, err := BuildKubeClient(configFlags)
+	if err != nil {
+		return err
+	}
+
+	if state == nil {
+		state, err = findSession(ctx, clientset, namespace, pvcName, mountPoint)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := unmount(mountPoint); err != nil {
+		return err
+	}
+
+	if err := stopPortForwarder(state); err != nil {
+		return err
+	}
+
+	if err := cleanSession(ctx, restConfig, clientset, state, os.Stdout); err != nil {
+		return err
+	}
+
+	// Forget the local record of the mount
+	return removeMountState(state.ID)
+}
+
+// cleanSession removes what a session created in the cluster: the tunnel in
+// the ephemeral container, the exposer or proxy pod, the Secret and the
+// Lease.
+func cleanSession(ctx context.Context, restConfig *rest.Config, clientset kubernetes.Interface, state *MountState, out io.Writer) error {
+	// Check for original pod
+	if state.TargetPodName != "" {
+		err := detachEphemeralContainer(ctx, restConfig, clientset, state.Namespace, state.TargetPodName, state.EphemeralContainer, out)
+		if err != nil {
+			return fmt.Errorf("failed to detach ephemeral container: %v", err)
+		}
+	}
+
+	// Delete the exposer or proxy pod, a mount kept after a failure may not
+	// have got that far
+	if state.PodName != "" {
+		if err := deletePod(ctx, clientset, state.Namespace, state.PodName, out); err != nil {
+			return err
+		}
+	}
+
+	// The pod owns the secret, but don't wait for the garbage collector
+	if err := deleteSessionSecret(ctx, clientset, state.Namespace, state.ID, out); err != nil {
+		return err
+	}
+	return deleteSessionLease(ctx, clientset, state.Namespace, state.ID, out)
+}
+
+// findSession locates the session serving mountPoint on this machine through
+// the annotations pv-mounter puts on its pods.
+func findSession(ctx context.Context, clientset kubernetes.Interface, namespace, pvcName, mountPoint string) (*MountState, error) {
+	hostName, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine hostname: %v", err)
+	}
+
+	selector := "app=volume-exposer"
+	// Pod and workload targets may have ended up with or without a PVC, the
+	// mount point alone has to do
+	if pvcName != "" && !strings.Contains(pvcName, "/") {
+		selector = fmt.Sprintf("%s,pvcName=%s", selector, pvcName)
+	}
+	podList, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %v", err)
+	}
+
+	var matches []corev1.Pod
+	for _, pod := range podList.Items {
+		if pod.Annotations[MountPointAnnotation] == mountPoint && pod.Annotations[HostNameAnnotation] == hostName {
+			matches = append(matches, pod)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no mount session found for %s in namespace %s", mountPoint, namespace)
+	case 1:
+		return sessionFromPod(&matches[0]), nil
+	default:
+		names := make([]string, 0, len(matches))
+		for _, pod := range matches {
+			names = append(names, pod.Name)
+		}
+		return nil, fmt.Errorf("several mount sessions found for %s: %s", mountPoint, strings.Join(names, ", "))
+	}
+}
+
+// sessionFromPod rebuilds as much of a MountState as the pod's labels and
+// annotations allow.
+func sessionFromPod(pod *corev1.Pod) *MountState {
+	return &MountState{
+		ID:                 pod.Labels[MountIDLabel],
+		Namespace:          pod.Namespace,
+		PVCName:            pod.Labels["pvcName"],
+		PodName:            pod.Name,
+		TargetPodName:      pod.Labels["originalPodName"],
+		EphemeralContainer: pod.Annotations[EphemeralContainerAnnotation],
+		MountPoint:         pod.Annotations[MountPointAnnotation],
+		CreatedAt:          pod.CreationTimestamp.Time,
+	}
+}
+
+func deletePod(ctx context.Context, clientset kubernetes.Interface, namespace, podName string, out io.Writer) error {
+	err := clientset.CoreV1().Pods(namespace).Delete(ctx, podName, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete pod: %v", err)
+	}
+	fmt.Fprintf(out, "Pod %s deleted successfully\n", podName)
+	return nil
+}
+
+func unmount(localMountPoint string) error {
+	mounted, err := isMounted(localMountPoint)
+	if err == nil && !mounted {
+		fmt.Printf("%s is not mounted, skipping unmount\n", localMountPoint)
+		return nil
+	}
+
 	// Unmount the local mount point
 	var umountCmd *exec.Cmd
 	if runtime.GOOS == "darwin" {
@@ -25,80 +180,124 @@ func Clean(ctx context.Context, namespace, pvcName, localMountPoint string) erro
 		return fmt.Errorf("failed to unmount SSHFS: %v", err)
 	}
 	fmt.Printf("Unmounted %s successfully\n", localMountPoint)
+	return nil
+}
 
-	// Build Kubernetes client
-	clientset, err := BuildKubeClient()
-	if err != nil {
-		return err
-	}
-
-	// List the pod with the PVC name label
-	podClient := clientset.CoreV1().Pods(namespace)
-	podList, err := podClient.List(ctx, metav1.ListOptions{
-		LabelSelector: fmt.Sprintf("pvcName=%s", pvcName),
-	})
-	if err != nil {
-		return fmt.Errorf("failed to list pods: %v", err)
+// stopPortForwarder terminates the background port-forward process, using
+// the recorded PID when there is one.
+func stopPortForwarder(state *MountState) error {
+	if state.PortForwardPID != 0 {
+		if !processAlive(state.PortForwardPID) {
+			fmt.Printf("Port-forward process %d already gone\n", state.PortForwardPID)
+			return nil
+		}
+		// The state outlives reboots, so the PID may have been reused since
+		if isPortForwarder(state.PortForwardPID, state) {
+			if err := syscall.Kill(state.PortForwardPID, syscall.SIGTERM); err != nil {
+				return fmt.Errorf("failed to kill port-forward process: %v", err)
+			}
+			fmt.Printf("Port-forward process for pod %s killed successfully\n", state.PodName)
+			return nil
+		}
+		fmt.Printf("Process %d is no longer the port-forward for pod %s, leaving it alone\n", state.PortForwardPID, state.PodName)
 	}
-
-	if len(podList.Items) == 0 {
-		return fmt.Errorf("no pod found with PVC name label %s", pvcName)
+	if state.PodName == "" {
+		return nil
 	}
 
-	podName := podList.Items[0].Name
-	port := podList.Items[0].Labels["portNumber"]
-
 	// Kill the port-forward process
-	pkillCmd := exec.Command("pkill", "-f", fmt.Sprintf("kubectl port-forward pod/%s %s:2137", podName, port))
+	pkillCmd := exec.Command("pkill", "-f", portForwardPattern(state.PodName))
 	pkillCmd.Stdout = os.Stdout
 	pkillCmd.Stderr = os.Stderr
 	if err := pkillCmd.Run(); err != nil {
+		// pkill exits with 1 when nothing matched, which is fine here
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			fmt.Printf("No port-forward process found for pod %s\n", state.PodName)
+			return nil
+		}
 		return fmt.Errorf("failed to kill port-forward process: %v", err)
 	}
-	fmt.Printf("Port-forward process for pod %s killed successfully\n", podName)
+	fmt.Printf("Port-forward process for pod %s killed successfully\n", state.PodName)
+	return nil
+}
 
-	// Check for original pod
-	originalPodName := podList.Items[0].Labels["originalPodName"]
-	if originalPodName != "" {
-		err = killProcessInEphemeralContainer(ctx, clientset, namespace, originalPodName)
-		if err != nil {
-			return fmt.Errorf("failed to kill process in ephemeral container: %v", err)
-		}
-		fmt.Printf("Process in ephemeral container killed successfully in pod %s\n", originalPodName)
+// isPortForwarder reports whether pid still runs the port-forward of state:
+// the hidden port-forward command of this binary, or a foreground mount of
+// the same mount point.
+func isPortForwarder(pid int, state *MountState) bool {
+	args, err := processArgs(pid)
+	if err != nil {
+		return false
 	}
-
-	// Delete the proxy pod
-	err = podClient.Delete(ctx, podName, metav1.DeleteOptions{})
+	self, err := os.Executable()
 	if err != nil {
-		return fmt.Errorf("failed to delete pod: %v", err)
+		return false
 	}
-	fmt.Printf("Proxy pod %s deleted successfully\n", podName)
+	return forwarderArgs(args, self, state)
+}
 
-	return nil
+// forwarderArgs matches the arguments of a process against the port-forward
+// of state, started from the executable self.
+func forwarderArgs(args []string, self string, state *MountState) bool {
+	if len(args) < 2 || filepath.Base(args[0]) != filepath.Base(self) {
+		return false
+	}
+	if strings.Join(args[1:], " ") == portForwardPattern(state.PodName) {
+		return true
+	}
+
+	foreground, mountPoint := false, false
+	for _, arg := range args[1:] {
+		switch {
+		case arg == "--foreground" || arg == "--foreground=true":
+			foreground = true
+		case filepath.IsAbs(arg):
+			mountPoint = mountPoint || filepath.Clean(arg) == state.MountPoint
+		case filepath.Base(arg) == filepath.Base(state.MountPoint):
+			// Relative to a working directory we can't know for sure
+			mountPoint = true
+		}
+	}
+	return foreground && mountPoint
 }
 
-func killProcessInEphemeralContainer(ctx context.Context, clientset *kubernetes.Clientset, namespace, podName string) error {
-	// Retrieve the existing pod to get the ephemeral container name
-	existingPod, err := clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+// processArgs returns the command line pid was started with.
+func processArgs(pid int) ([]string, error) {
+	if runtime.GOOS == "linux" {
+		data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+		if err != nil {
+			return nil, err
+		}
+		return strings.Split(strings.TrimRight(string(data), "\x00"), "\x00"), nil
+	}
+	output, err := exec.Command("ps", "-o", "command=", "-p", strconv.Itoa(pid)).Output()
 	if err != nil {
-		return fmt.Errorf("failed to get existing pod: %v", err)
+		return nil, err
 	}
+	return strings.Fields(string(output)), nil
+}
 
-	if len(existingPod.Spec.EphemeralContainers) == 0 {
-		return fmt.Errorf("no ephemeral containers found in pod %s", podName)
+func killProcessInEphemeralContainer(ctx context.Context, restConfig *rest.Config, clientset kubernetes.Interface, namespace, podName, ephemeralContainerName string, out io.Writer) error {
+	if ephemeralContainerName == "" {
+		return fmt.Errorf("no ephemeral container recorded for pod %s", podName)
 	}
+	fmt.Fprintf(out, "Ephemeral container name is %s\n", ephemeralContainerName)
 
-	ephemeralContainerName := existingPod.Spec.EphemeralContainers[0].Name
-	fmt.Printf("Ephemeral container name is %s\n", ephemeralContainerName)
-
-	// Command to kill the process (adjust the process name or ID as necessary)
-	killCmd := []string{"pkill", "-f", "tail"} // Replace "tail" with the actual process name or use a specific PID
+	// The entrypoint renames its keepalive process after the container. The
+	// container may share the process namespace with the workload, so nothing
+	// broader than that may be matched.
+	killCmd := []string{"pkill", "-f", keepalivePattern(ephemeralContainerName)}
 
-	cmd := exec.Command("kubectl", append([]string{"exec", podName, "-n", namespace, "-c", ephemeralContainerName, "--"}, killCmd...)...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
+	output, err := execInContainer(ctx, restConfig, clientset, namespace, podName, ephemeralContainerName, killCmd, nil)
+	fmt.Fprint(out, output)
+	if err != nil {
 		return fmt.Errorf("failed to kill process in container %s of pod %s: %v", ephemeralContainerName, podName, err)
 	}
 	return nil
 }
+
+// keepalivePattern matches the keepalive process of the ephemeral container
+// and nothing else.
+func keepalivePattern(ephemeralContainerName string) string {
+	return fmt.Sprintf("^%s ", ephemeralContainerName)
+}
@@ -0,0 +1,98 @@
+package plugin
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestFindSession(t *testing.T) {
+	ctx := context.Background()
+	other := testPod("volume-exposer-other", inSession(t, "other", "pvc-1", "/mnt/b"))
+	other.Annotations[HostNameAnnotation] = "someone-elses-laptop"
+	clientset := fake.NewSimpleClientset(
+		testPod("volume-exposer-aaaaa", inSession(t, "first", "pvc-1", "/mnt/a")),
+		testPod("volume-exposer-bbbbb", inSession(t, "second", "pvc-1", "/mnt/b")),
+		other,
+	)
+
+	t.Run("Same PVC mounted twice", func(t *testing.T) {
+		state, err := findSession(ctx, clientset, "default", "", "/mnt/b")
+		if err != nil {
+			t.Fatalf("findSession returned an error: %v", err)
+		}
+		if state.ID != "second" || state.PodName != "volume-exposer-bbbbb" {
+			t.Errorf("Expected session second, got %+v", state)
+		}
+	})
+
+	t.Run("Narrowed down to PVC", func(t *testing.T) {
+		if _, err := findSession(ctx, clientset, "default", "pvc-2", "/mnt/a"); err == nil {
+			t.Error("Expected no session for a different PVC")
+		}
+	})
+
+	t.Run("Unknown mount point", func(t *testing.T) {
+		if _, err := findSession(ctx, clientset, "default", "", "/mnt/c"); err == nil {
+			t.Error("Expected an error for an unknown mount point")
+		}
+	})
+
+	t.Run("Ambiguous", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(
+			testPod("volume-exposer-aaaaa", inSession(t, "first", "pvc-1", "/mnt/a")),
+			testPod("volume-exposer-ccccc", inSession(t, "third", "pvc-1", "/mnt/a")),
+		)
+		_, err := findSession(ctx, clientset, "default", "", "/mnt/a")
+		if err == nil || !strings.Contains(err.Error(), "several") {
+			t.Errorf("Expected an ambiguity error, got %v", err)
+		}
+	})
+}
+
+func TestSessionFromPod(t *testing.T) {
+	pod := testPod("volume-exposer-proxy-aaaaa", inSession(t, "abc", "pvc-1", "/mnt/a"))
+	pod.Labels["originalPodName"] = "web-0"
+	pod.Annotations[EphemeralContainerAnnotation] = "volume-exposer-ephemeral-xyz"
+
+	state := sessionFromPod(pod)
+	if state.ID != "abc" || state.PVCName != "pvc-1" || state.Namespace != "default" {
+		t.Errorf("Unexpected session identity: %+v", state)
+	}
+	if state.TargetPodName != "web-0" || state.EphemeralContainer != "volume-exposer-ephemeral-xyz" {
+		t.Errorf("Unexpected ephemeral container details: %+v", state)
+	}
+}
+
+func TestForwarderArgs(t *testing.T) {
+	self := "/usr/local/bin/kubectl-pv_mounter"
+	state := &MountState{PodName: "volume-exposer-abcde", MountPoint: "/home/me/data"}
+	tests := []struct {
+		name string
+		args []string
+		want bool
+	}{
+		{name: "background port-forward", args: []string{self, "port-forward", "pod/volume-exposer-abcde"}, want: true},
+		{name: "port-forward of another pod", args: []string{self, "port-forward", "pod/volume-exposer-abcdef"}},
+		{name: "foreground mount", args: []string{"kubectl-pv_mounter", "mount", "--foreground", "default", "pvc", "data"}, want: true},
+		{name: "foreground mount by absolute path", args: []string{self, "mount", "--foreground=true", "default", "pvc", "/home/me/data/"}, want: true},
+		{name: "foreground mount elsewhere", args: []string{self, "mount", "--foreground", "default", "pvc", "/tmp/other"}},
+		{name: "background mount", args: []string{self, "mount", "default", "pvc", "/home/me/data"}},
+		{name: "reused PID", args: []string{"/usr/bin/sleep", "port-forward", "pod/volume-exposer-abcde"}},
+		{name: "no arguments", args: []string{self}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := forwarderArgs(tt.args, self, state); got != tt.want {
+				t.Errorf("forwarderArgs(%q) = %v, want %v", tt.args, got, tt.want)
+			}
+		})
+	}
+
+	if isPortForwarder(os.Getpid(), state) {
+		t.Error("Expected the test binary not to pass for the port-forward")
+	}
+}
@@ -0,0 +1,257 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// DefaultStartTimeout is how long the pods and the ephemeral container get to
+// start when MountOptions.Timeout isn't set. It covers pulling the image on a
+// cold node.
+const DefaultStartTimeout = 5 * time.Minute
+
+// Waiting reasons of a container that won't resolve by waiting longer.
+var imagePullFailureReasons = map[string]bool{
+	"ErrImagePull":      true,
+	"ImagePullBackOff":  true,
+	"InvalidImageName":  true,
+	"ErrImageNeverPull": true,
+}
+
+// startFailure is a pod that won't become ready by itself.
+type startFailure struct {
+	message string
+	// container, when set, has logs that explain the failure.
+	container string
+}
+
+func (f *startFailure) Error() string {
+	return f.message
+}
+
+// waitForPodReady waits until the pod is ready. Scheduling, volume attach,
+// image pull and crash failures are reported as soon as the pod or its
+// Events show them, instead of after the timeout.
+func waitForPodReady(ctx context.Context, clientset kubernetes.Interface, namespace, podName string, timeout time.Duration) error {
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var lastPod *corev1.Pod
+	var lastEvents []corev1.Event
+	err := waitForPod(waitCtx, clientset, namespace, podName, true, func(pod *corev1.Pod, events []corev1.Event) (bool, error) {
+		lastPod, lastEvents = pod, events
+		if podReady(pod) {
+			return true, nil
+		}
+		if failure := podStartFailure(pod, events); failure != nil {
+			return false, failure
+		}
+		return false, nil
+	})
+	if failure, ok := err.(*startFailure); ok {
+		if failure.container == "" {
+			return failure
+		}
+		if logs := containerLogs(ctx, clientset, namespace, podName, failure.container); logs != "" {
+			return fmt.Errorf("%s\nContainer logs:\n%s", failure.message, logs)
+		}
+		return failure
+	}
+	if waitCtx.Err() != nil && ctx.Err() == nil {
+		if lastPod == nil {
+			return fmt.Errorf("pod %s is not ready after %s, it was never seen", podName, timeout)
+		}
+		return fmt.Errorf("pod %s is not ready after %s: %s", podName, timeout, describePodProgress(lastPod, lastEvents))
+	}
+	return err
+}
+
+func podReady(pod *corev1.Pod) bool {
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady && cond.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// eventsOf picks the Events of pod from store, oldest first. The store may
+// hold more when the server doesn't honour the field selector.
+func eventsOf(pod *corev1.Pod, store cache.Store) []corev1.Event {
+	if store == nil {
+		return nil
+	}
+	var events []corev1.Event
+	for _, obj := range store.List() {
+		event, ok := obj.(*corev1.Event)
+		if !ok || event.InvolvedObject.Name != pod.Name || (event.InvolvedObject.UID != "" && event.InvolvedObject.UID != pod.UID) {
+			continue
+		}
+		events = append(events, *event)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return eventTime(events[i]).Before(eventTime(events[j]))
+	})
+	return events
+}
+
+func eventTime(event corev1.Event) time.Time {
+	switch {
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	case !event.EventTime.IsZero():
+		return event.EventTime.Time
+	}
+	return event.CreationTimestamp.Time
+}
+
+// podStartFailure explains why pod won't become ready, or returns nil while
+// it still may.
+func podStartFailure(pod *corev1.Pod, events []corev1.Event) *startFailure {
+	if pod.Status.Phase == corev1.PodFailed {
+		return &startFailure{message: fmt.Sprintf("pod %s failed: %s", pod.Name, describeReason(pod.Status.Reason, pod.Status.Message))}
+	}
+
+	statuses := append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...)
+	for _, status := range statuses {
+		waiting := status.State.Waiting
+		if waiting == nil {
+			continue
+		}
+		switch {
+		case imagePullFailureReasons[waiting.Reason]:
+			return &startFailure{message: fmt.Sprintf("pod %s can't pull image %s: %s\nCheck that the nodes can reach the registry, or mirror the image and allow pulling it in this namespace",
+				pod.Name, status.Image, describeReason(waiting.Reason, waiting.Message))}
+		case waiting.Reason == "CrashLoopBackOff":
+			return &startFailure{
+				message:   fmt.Sprintf("container %s of pod %s keeps crashing, last run %s", status.Name, pod.Name, describeContainerState(status.LastTerminationState)),
+				container: status.Name,
+			}
+		case waiting.Reason == "CreateContainerConfigError" || waiting.Reason == "CreateContainerError" || waiting.Reason == "RunContainerError":
+			return &startFailure{message: fmt.Sprintf("container %s of pod %s can't start: %s", status.Name, pod.Name, describeReason(waiting.Reason, waiting.Message))}
+		}
+	}
+
+	// Only the latest word on scheduling counts: the autoscaler may be adding
+	// a node, or the scheduler may have found one since
+	var scheduling *corev1.Event
+	for i := range events {
+		event := &events[i]
+		switch event.Reason {
+		case "FailedScheduling", "TriggeredScaleUp", "Scheduled":
+			scheduling = event
+		case "FailedAttachVolume":
+			// A container that started has its volume, the attach got retried
+			if !containersStarted(pod) {
+				return &startFailure{message: attachFailure(pod.Name, event.Message)}
+			}
+		}
+	}
+	if scheduling != nil && scheduling.Reason == "FailedScheduling" && pod.Spec.NodeName == "" {
+		return &startFailure{message: schedulingFailure(pod.Name, scheduling.Message)}
+	}
+	return nil
+}
+
+func containersStarted(pod *corev1.Pod) bool {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Running != nil || status.State.Terminated != nil || status.LastTerminationState.Terminated != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// schedulingFailure explains a FailedScheduling event of the pod.
+func schedulingFailure(podName, message string) string {
+	var hints []string
+	if strings.Contains(message, "volume node affinity conflict") {
+		hints = append(hints, "The volume can only be used in some zones or on some nodes, and none of them can run the pod.")
+	}
+	if strings.Contains(message, "taint") {
+		hints = append(hints, "The nodes have taints the pod doesn't tolerate; only pods pinned to a node tolerate every taint.")
+	}
+	if strings.Contains(message, "Insufficient") || strings.Contains(message, "Too many pods") {
+		hints = append(hints, "The nodes are out of resources for another pod; free some up or add a node.")
+	}
+	if strings.Contains(message, "unbound immediate PersistentVolumeClaims") {
+		hints = append(hints, "The PVC isn't usable yet; check that it's bound and not being deleted.")
+	}
+	// Pinned pods don't match any other node, so that's only worth a word
+	// when nothing else is wrong
+	if len(hints) == 0 && strings.Contains(message, "node affinity") {
+		hints = append(hints, "The pod is pinned to the node that has the volume attached, and that node can't take it right now.")
+	}
+	failure := fmt.Sprintf("pod %s can't be scheduled: %s", podName, message)
+	if len(hints) > 0 {
+		failure += "\n" + strings.Join(hints, "\n")
+	}
+	return failure
+}
+
+// attachFailure explains a FailedAttachVolume event of the pod.
+func attachFailure(podName, message string) string {
+	if strings.Contains(message, "Multi-Attach") {
+		return fmt.Sprintf("the volume of pod %s is still attached to another node: %s\n"+
+			"A ReadWriteOnce volume attaches to one node at a time. Wait until the pod that used it is gone, "+
+			"or mount it while that pod runs, so pv-mounter puts its pod on the same node; --target-pod names that pod when it isn't picked.", podName, message)
+	}
+	return fmt.Sprintf("the volume of pod %s can't be attached: %s", podName, message)
+}
+
+// admissionFailure explains a pod that Pod Security admission rejected, and
+// returns err unchanged otherwise.
+func admissionFailure(err error, namespace string, needsRoot bool) error {
+	if !apierrors.IsForbidden(err) || !strings.Contains(err.Error(), "PodSecurity") {
+		return err
+	}
+	level := "baseline"
+	if needsRoot {
+		level = "privileged"
+	}
+	return fmt.Errorf("%v\nThe Pod Security admission of namespace %s rejected the pod. "+
+		"pv-mounter needs the %q level there (see the namespace's pod-security.kubernetes.io/enforce label)", err, namespace, level)
+}
+
+// describePodProgress sums up where a pod that isn't ready got stuck.
+func describePodProgress(pod *corev1.Pod, events []corev1.Event) string {
+	parts := []string{fmt.Sprintf("phase %s", pod.Status.Phase)}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Status == corev1.ConditionTrue {
+			continue
+		}
+		description := fmt.Sprintf("%s=%s", cond.Type, cond.Status)
+		if cond.Reason != "" || cond.Message != "" {
+			description += " (" + describeReason(cond.Reason, cond.Message) + ")"
+		}
+		parts = append(parts, description)
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		parts = append(parts, fmt.Sprintf("container %s %s", status.Name, describeContainerState(status.State)))
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Type == corev1.EventTypeWarning {
+			parts = append(parts, "last warning: "+describeReason(events[i].Reason, events[i].Message))
+			break
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func describeReason(reason, message string) string {
+	switch {
+	case reason == "":
+		return message
+	case message == "":
+		return reason
+	}
+	return fmt.Sprintf("%s: %s", reason, message)
+}
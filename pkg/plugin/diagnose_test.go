@@ -0,0 +1,210 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func diagnoseTestEvent(name, reason, message string, at time.Time) *corev1.Event {
+	return &corev1.Event{
+		ObjectMeta:     metav1.ObjectMeta{Name: name, Namespace: "default"},
+		InvolvedObject: corev1.ObjectReference{Kind: "Pod", Name: "volume-exposer-abcde", UID: "pod-uid"},
+		Type:           corev1.EventTypeWarning,
+		Reason:         reason,
+		Message:        message,
+		LastTimestamp:  metav1.NewTime(at),
+	}
+}
+
+func TestPodStartFailure(t *testing.T) {
+	now := time.Now()
+	withWaiting := func(reason, message string) *corev1.Pod {
+		pod := pendingExposerPod()
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+			Name:  "volume-exposer",
+			Image: Image,
+			State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: reason, Message: message}},
+			LastTerminationState: corev1.ContainerState{
+				Terminated: &corev1.ContainerStateTerminated{ExitCode: 1, Reason: "Error"},
+			},
+		}}
+		return pod
+	}
+	scheduled := pendingExposerPod()
+	scheduled.Spec.NodeName = "node-1"
+	failed := pendingExposerPod()
+	failed.Status.Phase = corev1.PodFailed
+	failed.Status.Reason = "DeadlineExceeded"
+	running := withWaiting("", "")
+	running.Status.ContainerStatuses[0].State = corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+
+	tests := []struct {
+		name   string
+		pod    *corev1.Pod
+		events []*corev1.Event
+		want   []string
+	}{
+		{
+			name: "pending without news keeps waiting",
+			pod:  pendingExposerPod(),
+		},
+		{
+			name: "image pull",
+			pod:  withWaiting("ImagePullBackOff", "Back-off pulling image"),
+			want: []string{"can't pull image " + Image, "ImagePullBackOff", "registry"},
+		},
+		{
+			name: "crash loop",
+			pod:  withWaiting("CrashLoopBackOff", "back-off 10s"),
+			want: []string{"keeps crashing", "exit code 1"},
+		},
+		{
+			name: "config error",
+			pod:  withWaiting("CreateContainerConfigError", `secret "volume-exposer-abcde" not found`),
+			want: []string{"can't start", "not found"},
+		},
+		{
+			name: "failed pod",
+			pod:  failed,
+			want: []string{"failed", "DeadlineExceeded"},
+		},
+		{
+			name: "untolerated taint",
+			pod:  pendingExposerPod(),
+			events: []*corev1.Event{
+				diagnoseTestEvent("e1", "FailedScheduling", "0/3 nodes are available: 3 node(s) had untolerated taint {dedicated: db}.", now),
+			},
+			want: []string{"can't be scheduled", "untolerated taint", "taints the pod doesn't tolerate"},
+		},
+		{
+			name: "insufficient resources",
+			pod:  pendingExposerPod(),
+			events: []*corev1.Event{
+				diagnoseTestEvent("e1", "FailedScheduling", "0/3 nodes are available: 1 Insufficient cpu, 2 node(s) didn't match Pod's node affinity/selector.", now),
+			},
+			want: []string{"out of resources"},
+		},
+		{
+			name: "pinned node",
+			pod:  pendingExposerPod(),
+			events: []*corev1.Event{
+				diagnoseTestEvent("e1", "FailedScheduling", "0/3 nodes are available: 3 node(s) didn't match Pod's node affinity/selector.", now),
+			},
+			want: []string{"pinned to the node"},
+		},
+		{
+			name: "autoscaler adding a node",
+			pod:  pendingExposerPod(),
+			events: []*corev1.Event{
+				diagnoseTestEvent("e1", "FailedScheduling", "0/3 nodes are available: 3 Insufficient memory.", now.Add(-time.Minute)),
+				diagnoseTestEvent("e2", "TriggeredScaleUp", "pod triggered scale-up", now),
+			},
+		},
+		{
+			name: "scheduled after all",
+			pod:  scheduled,
+			events: []*corev1.Event{
+				diagnoseTestEvent("e1", "FailedScheduling", "0/3 nodes are available: 3 Insufficient memory.", now),
+			},
+		},
+		{
+			name: "multi-attach",
+			pod:  scheduled,
+			events: []*corev1.Event{
+				diagnoseTestEvent("e1", "FailedAttachVolume", `Multi-Attach error for volume "pvc-123" Volume is already exclusively attached to one node and can't be attached to another`, now),
+			},
+			want: []string{"still attached to another node", "on the same node", "--target-pod"},
+		},
+		{
+			name: "attach retried",
+			pod:  running,
+			events: []*corev1.Event{
+				diagnoseTestEvent("e1", "FailedAttachVolume", "timed out waiting for the condition", now),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []corev1.Event
+			for _, event := range tt.events {
+				events = append(events, *event)
+			}
+			failure := podStartFailure(tt.pod, events)
+			if len(tt.want) == 0 {
+				if failure != nil {
+					t.Fatalf("Expected to keep waiting, got %v", failure)
+				}
+				return
+			}
+			if failure == nil {
+				t.Fatal("Expected a failure")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(failure.Error(), want) {
+					t.Errorf("Expected %q in %q", want, failure.Error())
+				}
+			}
+		})
+	}
+}
+
+func TestWaitForPodReady(t *testing.T) {
+	ctx := context.Background()
+
+	ready := pendingExposerPod()
+	ready.Status.Phase = corev1.PodRunning
+	ready.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	if err := waitForPodReady(ctx, fake.NewSimpleClientset(ready), "default", ready.Name, time.Minute); err != nil {
+		t.Errorf("Expected a ready pod to be accepted, got %v", err)
+	}
+
+	pending := pendingExposerPod()
+	other := diagnoseTestEvent("other", "FailedScheduling", "0/3 nodes are available: 3 Insufficient memory.", time.Now())
+	other.InvolvedObject.Name = "someone-else"
+	clientset := fake.NewSimpleClientset(pending, other,
+		diagnoseTestEvent("e1", "FailedScheduling", "0/1 nodes are available: 1 node(s) had untolerated taint {gpu: true}.", time.Now()))
+	start := time.Now()
+	err := waitForPodReady(ctx, clientset, "default", pending.Name, time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "untolerated taint") {
+		t.Errorf("Expected the scheduling failure to be reported, got %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("Expected to fail fast, took %s", time.Since(start))
+	}
+
+	pending.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodScheduled, Status: corev1.ConditionFalse, Reason: "Unschedulable"}}
+	err = waitForPodReady(ctx, fake.NewSimpleClientset(pending), "default", pending.Name, 1500*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "not ready after") || !strings.Contains(err.Error(), "Unschedulable") {
+		t.Errorf("Expected the timeout to describe the pod, got %v", err)
+	}
+}
+
+func TestAdmissionFailure(t *testing.T) {
+	rejected := apierrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "volume-exposer-abcde",
+		errors.New(`violates PodSecurity "baseline:latest": non-default capabilities (container "volume-exposer" must not include "SYS_ADMIN")`))
+
+	err := admissionFailure(rejected, "apps", true)
+	for _, want := range []string{"SYS_ADMIN", "namespace apps", `"privileged"`, "pod-security.kubernetes.io/enforce"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in %q", want, err.Error())
+		}
+	}
+	if err := admissionFailure(rejected, "apps", false); !strings.Contains(err.Error(), `"baseline"`) {
+		t.Errorf("Expected the baseline level without --needs-root, got %v", err)
+	}
+
+	other := apierrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "volume-exposer-abcde", errors.New("RBAC says no"))
+	if err := admissionFailure(other, "apps", false); err != error(other) {
+		t.Errorf("Expected other errors to pass through, got %v", err)
+	}
+}
@@ -0,0 +1,231 @@
+package plugin
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// EphemeralContainerPrefix starts the name of every ephemeral container
+	// pv-mounter adds.
+	EphemeralContainerPrefix = "volume-exposer-ephemeral-"
+	// ephemeralLogLines is how much of the container log a failure shows.
+	ephemeralLogLines = int64(20)
+	// ephemeralIdleTimeout is how long an ephemeral container without a
+	// tunnel waits to be reused before it stops. It can't be removed, but it
+	// lets go of the volume and its resources.
+	ephemeralIdleTimeout = time.Hour
+)
+
+// Waiting reasons that won't resolve by waiting longer.
+var ephemeralFailureReasons = map[string]bool{
+	"ErrImagePull":               true,
+	"ImagePullBackOff":           true,
+	"InvalidImageName":           true,
+	"ErrImageNeverPull":          true,
+	"CreateContainerConfigError": true,
+	"CreateContainerError":       true,
+	"RunContainerError":          true,
+}
+
+// reusableEphemeralContainer picks a running pv-mounter ephemeral container
+// of pod that's set up like desired, down to its lifetime, and not used by
+// another session. Ephemeral containers can't be removed, so reusing them
+// keeps the pod spec from growing with every mount.
+func reusableEphemeralContainer(pod *corev1.Pod, desired corev1.EphemeralContainer, claimed map[string]bool) string {
+	for _, container := range pod.Spec.EphemeralContainers {
+		if !strings.HasPrefix(container.Name, EphemeralContainerPrefix) || claimed[container.Name] {
+			continue
+		}
+		if !ephemeralContainerRunning(pod, container.Name) {
+			continue
+		}
+		if container.Image != desired.Image ||
+			container.TargetContainerName != desired.TargetContainerName ||
+			!apiequality.Semantic.DeepEqual(container.VolumeMounts, desired.VolumeMounts) ||
+			!apiequality.Semantic.DeepEqual(container.SecurityContext, desired.SecurityContext) ||
+			envValue(container.Env, "MAX_LIFETIME") != envValue(desired.Env, "MAX_LIFETIME") {
+			continue
+		}
+		return container.Name
+	}
+	return ""
+}
+
+func envValue(env []corev1.EnvVar, name string) string {
+	for _, variable := range env {
+		if variable.Name == name {
+			return variable.Value
+		}
+	}
+	return ""
+}
+
+// claimedEphemeralContainers lists the ephemeral containers of podName that
+// proxy pods of live sessions are tunnelled to.
+func claimedEphemeralContainers(ctx context.Context, clientset kubernetes.Interface, namespace, podName string) (map[string]bool, error) {
+	proxies, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("app=volume-exposer,originalPodName=%s", podName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list proxy pods: %v", err)
+	}
+	claimed := map[string]bool{}
+	for _, proxy := range proxies.Items {
+		if name := proxy.Annotations[EphemeralContainerAnnotation]; name != "" {
+			claimed[name] = true
+		}
+	}
+	return claimed, nil
+}
+
+// restartTunnel starts a new session in a running ephemeral container: sshd
+// with the new keys and the tunnel to the new proxy pod. The keys go over
+// the exec stream, never into the pod spec. The container's lifetime, in
+// seconds, starts over with the session.
+func restartTunnel(ctx context.Context, restConfig *rest.Config, clientset kubernetes.Interface, namespace, podName, containerName string, keys *sessionKeys, proxyPodIP, maxLifetime string) error {
+	var session strings.Builder
+	for _, value := range []struct {
+		name  string
+		value string
+	}{
+		{"SSH_PUBLIC_KEY", keys.publicKey},
+		{"SSH_PRIVATE_KEY", keys.privateKey},
+		{"SSH_HOST_KEY", keys.hostKey},
+		{"SSH_HOST_PUBLIC_KEY", keys.hostPublicKey},
+		{"PROXY_POD_IP", proxyPodIP},
+		{"MAX_LIFETIME", maxLifetime},
+	} {
+		fmt.Fprintf(&session, "%s=%s\n", value.name, base64.StdEncoding.EncodeToString([]byte(value.value)))
+	}
+
+	output, err := execInContainer(ctx, restConfig, clientset, namespace, podName, containerName, []string{"/tunnel.sh", "start", "--stdin"}, strings.NewReader(session.String()))
+	fmt.Print(output)
+	if err != nil {
+		return fmt.Errorf("failed to restart the tunnel in container %s: %v", containerName, err)
+	}
+	return nil
+}
+
+// detachEphemeralContainer ends the session in the ephemeral container and
+// leaves the container running for the next mount. Containers from older
+// images can't do that and are stopped instead.
+func detachEphemeralContainer(ctx context.Context, restConfig *rest.Config, clientset kubernetes.Interface, namespace, podName, ephemeralContainerName string, out io.Writer) error {
+	if ephemeralContainerName == "" {
+		return fmt.Errorf("no ephemeral container recorded for pod %s", podName)
+	}
+	output, err := execInContainer(ctx, restConfig, clientset, namespace, podName, ephemeralContainerName, []string{"/tunnel.sh", "stop"}, nil)
+	fmt.Fprint(out, output)
+	if err == nil {
+		fmt.Fprintf(out, "Ephemeral container %s detached, it's kept for the next mount\n", ephemeralContainerName)
+		return nil
+	}
+	fmt.Fprintf(out, "Could not detach ephemeral container %s (%v), stopping it\n", ephemeralContainerName, err)
+	return killProcessInEphemeralContainer(ctx, restConfig, clientset, namespace, podName, ephemeralContainerName, out)
+}
+
+// waitForEphemeralContainer waits until the ephemeral container runs. Image
+// pull and start failures are reported right away, with the container's
+// state and logs.
+func waitForEphemeralContainer(ctx context.Context, clientset kubernetes.Interface, namespace, podName, containerName string, timeout time.Duration) error {
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var lastState string
+	err := waitForPod(waitCtx, clientset, namespace, podName, false, func(pod *corev1.Pod, _ []corev1.Event) (bool, error) {
+		for _, status := range pod.Status.EphemeralContainerStatuses {
+			if status.Name != containerName {
+				continue
+			}
+			lastState = describeContainerState(status.State)
+			switch {
+			case status.State.Running != nil:
+				return true, nil
+			case status.State.Terminated != nil:
+				return false, ephemeralContainerFailure(ctx, clientset, namespace, podName, containerName, lastState)
+			case status.State.Waiting != nil && ephemeralFailureReasons[status.State.Waiting.Reason]:
+				return false, ephemeralContainerFailure(ctx, clientset, namespace, podName, containerName, lastState)
+			}
+		}
+		return false, nil
+	})
+	if waitCtx.Err() != nil && ctx.Err() == nil {
+		if lastState == "" {
+			lastState = "not reported yet"
+		}
+		return fmt.Errorf("ephemeral container %s did not start within %s, last state: %s", containerName, timeout, lastState)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Ephemeral container %s is running\n", containerName)
+	return nil
+}
+
+func ephemeralContainerFailure(ctx context.Context, clientset kubernetes.Interface, namespace, podName, containerName, state string) error {
+	message := fmt.Sprintf("ephemeral container %s failed: %s", containerName, state)
+	if logs := containerLogs(ctx, clientset, namespace, podName, containerName); logs != "" {
+		message += "\nContainer logs:\n" + logs
+	}
+	return fmt.Errorf("%s", message)
+}
+
+func describeContainerState(state corev1.ContainerState) string {
+	switch {
+	case state.Running != nil:
+		return "running"
+	case state.Terminated != nil:
+		description := fmt.Sprintf("terminated with exit code %d", state.Terminated.ExitCode)
+		if state.Terminated.Reason != "" {
+			description += fmt.Sprintf(" (%s)", state.Terminated.Reason)
+		}
+		if state.Terminated.Message != "" {
+			description += ": " + state.Terminated.Message
+		}
+		return description
+	case state.Waiting != nil:
+		description := "waiting"
+		if state.Waiting.Reason != "" {
+			description += fmt.Sprintf(" (%s)", state.Waiting.Reason)
+		}
+		if state.Waiting.Message != "" {
+			description += ": " + state.Waiting.Message
+		}
+		return description
+	}
+	return "unknown"
+}
+
+// containerLogs returns the tail of the container's log, or nothing when it
+// can't be read.
+func containerLogs(ctx context.Context, clientset kubernetes.Interface, namespace, podName, containerName string) string {
+	tailLines := ephemeralLogLines
+	logs, err := clientset.CoreV1().Pods(namespace).GetLogs(podName, &corev1.PodLogOptions{
+		Container: containerName,
+		TailLines: &tailLines,
+	}).DoRaw(ctx)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(logs))
+}
+
+// tunnelLogs explains a tunnel that doesn't come up: the log of the session
+// restarted over exec, or else the container log.
+func tunnelLogs(ctx context.Context, restConfig *rest.Config, clientset kubernetes.Interface, namespace, podName, containerName string) string {
+	output, err := execInContainer(ctx, restConfig, clientset, namespace, podName, containerName, []string{"/tunnel.sh", "logs"}, nil)
+	if err == nil && strings.TrimSpace(output) != "" {
+		return strings.TrimSpace(output)
+	}
+	return containerLogs(ctx, clientset, namespace, podName, containerName)
+}
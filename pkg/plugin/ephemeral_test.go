@@ -0,0 +1,98 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestReusableEphemeralContainer(t *testing.T) {
+	running := corev1.ContainerState{Running: &corev1.ContainerStateRunning{}}
+	stopped := corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0}}
+	spec := func(name string, readOnly bool) corev1.EphemeralContainer {
+		return createEphemeralContainerSpec(name, "data", "volume-exposer-abcdefgh", "10.0.0.1", nil, false, readOnly)
+	}
+	withLifetime := func(container corev1.EphemeralContainer, seconds string) corev1.EphemeralContainer {
+		container.Env = append(container.Env, corev1.EnvVar{Name: "MAX_LIFETIME", Value: seconds})
+		return container
+	}
+	desired := withLifetime(spec("volume-exposer-ephemeral-new00", false), "86400")
+
+	tests := []struct {
+		name    string
+		pod     *corev1.Pod
+		claimed map[string]bool
+		want    string
+	}{
+		{
+			name: "reuses a running idle container",
+			pod:  testPod("app", withEphemeralContainers(map[string]corev1.ContainerState{"volume-exposer-ephemeral-old00": running}, withLifetime(spec("volume-exposer-ephemeral-old00", false), "86400"))),
+			want: "volume-exposer-ephemeral-old00",
+		},
+		{
+			name: "skips stopped containers",
+			pod:  testPod("app", withEphemeralContainers(map[string]corev1.ContainerState{"volume-exposer-ephemeral-old00": stopped}, spec("volume-exposer-ephemeral-old00", false))),
+		},
+		{
+			name:    "skips containers of live sessions",
+			pod:     testPod("app", withEphemeralContainers(map[string]corev1.ContainerState{"volume-exposer-ephemeral-old00": running}, spec("volume-exposer-ephemeral-old00", false))),
+			claimed: map[string]bool{"volume-exposer-ephemeral-old00": true},
+		},
+		{
+			name: "skips containers set up differently",
+			pod:  testPod("app", withEphemeralContainers(map[string]corev1.ContainerState{"volume-exposer-ephemeral-old00": running}, spec("volume-exposer-ephemeral-old00", true))),
+		},
+		{
+			name: "skips containers with another lifetime",
+			pod:  testPod("app", withEphemeralContainers(map[string]corev1.ContainerState{"volume-exposer-ephemeral-old00": running}, withLifetime(spec("volume-exposer-ephemeral-old00", false), "3600"))),
+		},
+		{
+			name: "finds the right container by name",
+			pod: testPod("app", withEphemeralContainers(map[string]corev1.ContainerState{"debugger": running, "volume-exposer-ephemeral-old00": stopped, "volume-exposer-ephemeral-old01": running},
+				corev1.EphemeralContainer{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger", Image: desired.Image}},
+				spec("volume-exposer-ephemeral-old00", false),
+				withLifetime(spec("volume-exposer-ephemeral-old01", false), "86400"))),
+			want: "volume-exposer-ephemeral-old01",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := reusableEphemeralContainer(tt.pod, desired, tt.claimed); got != tt.want {
+				t.Errorf("reusableEphemeralContainer() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWaitForEphemeralContainer(t *testing.T) {
+	ctx := context.Background()
+	name := "volume-exposer-ephemeral-abcde"
+	container := corev1.EphemeralContainer{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: name}}
+
+	clientset := fake.NewSimpleClientset(testPod("app", withEphemeralContainers(map[string]corev1.ContainerState{
+		name: {Running: &corev1.ContainerStateRunning{}},
+	}, container)))
+	if err := waitForEphemeralContainer(ctx, clientset, "default", "app", name, DefaultStartTimeout); err != nil {
+		t.Errorf("Expected a running container to be accepted, got %v", err)
+	}
+
+	clientset = fake.NewSimpleClientset(testPod("app", withEphemeralContainers(map[string]corev1.ContainerState{
+		name: {Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff", Message: "manifest unknown"}},
+	}, container)))
+	err := waitForEphemeralContainer(ctx, clientset, "default", "app", name, DefaultStartTimeout)
+	if err == nil || !strings.Contains(err.Error(), "ImagePullBackOff") || !strings.Contains(err.Error(), "manifest unknown") {
+		t.Errorf("Expected the image pull failure to be reported, got %v", err)
+	}
+
+	clientset = fake.NewSimpleClientset(testPod("app", withEphemeralContainers(map[string]corev1.ContainerState{
+		name: {Terminated: &corev1.ContainerStateTerminated{ExitCode: 1, Reason: "Error"}},
+	}, container)))
+	err = waitForEphemeralContainer(ctx, clientset, "default", "app", name, DefaultStartTimeout)
+	if err == nil || !strings.Contains(err.Error(), "exit code 1") {
+		t.Errorf("Expected the crash to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,61 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+// execInContainer runs command in a container of the pod and returns its
+// combined output. Like port-forwarding, it prefers WebSockets and falls
+// back to SPDY.
+func execInContainer(ctx context.Context, restConfig *rest.Config, clientset kubernetes.Interface, namespace, podName, containerName string, command []string, stdin io.Reader) (string, error) {
+	req := clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(podName).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: containerName,
+			Command:   command,
+			Stdin:     stdin != nil,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+
+	spdyExecutor, err := remotecommand.NewSPDYExecutor(restConfig, http.MethodPost, req.URL())
+	if err != nil {
+		return "", fmt.Errorf("failed to create SPDY executor: %v", err)
+	}
+	websocketExecutor, err := remotecommand.NewWebSocketExecutor(restConfig, http.MethodGet, req.URL().String())
+	if err != nil {
+		return "", fmt.Errorf("failed to create WebSocket executor: %v", err)
+	}
+	executor, err := remotecommand.NewFallbackExecutor(websocketExecutor, spdyExecutor, func(err error) bool {
+		return httpstream.IsUpgradeFailure(err) || httpstream.IsHTTPSProxyError(err)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create executor: %v", err)
+	}
+
+	var output bytes.Buffer
+	err = executor.StreamWithContext(ctx, remotecommand.StreamOptions{
+		Stdin:  stdin,
+		Stdout: &output,
+		Stderr: &output,
+	})
+	if err != nil {
+		return output.String(), fmt.Errorf("command %q failed in container %s of pod %s: %v", strings.Join(command, " "), containerName, podName, err)
+	}
+	return output.String(), nil
+}
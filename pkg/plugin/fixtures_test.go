@@ -0,0 +1,179 @@
+package plugin
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Objects shared by the tests, all in the default namespace.
+
+var (
+	tokenVolume  = corev1.Volume{Name: "kube-api-access-x7k2p", VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{}}}
+	cacheVolume  = corev1.Volume{Name: "cache", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}
+	configVolume = corev1.Volume{Name: "config", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{}}}
+	dataVolume   = corev1.Volume{Name: "data", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "data-web-0"}}}
+	tmpVolume    = corev1.Volume{Name: "scratch", VolumeSource: corev1.VolumeSource{Ephemeral: &corev1.EphemeralVolumeSource{}}}
+)
+
+func intPtr(v int) *int {
+	return &v
+}
+
+func int64Ptr(v int64) *int64 {
+	return &v
+}
+
+// testStatefulSet has a claim template for each of claimTemplates.
+func testStatefulSet(name string, replicas int32, claimTemplates []string, volumes ...corev1.Volume) *appsv1.StatefulSet {
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas: &replicas,
+			Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{Volumes: volumes}},
+		},
+	}
+	for _, template := range claimTemplates {
+		sts.Spec.VolumeClaimTemplates = append(sts.Spec.VolumeClaimTemplates, corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: template}})
+	}
+	return sts
+}
+
+func testPVC(name string) *corev1.PersistentVolumeClaim {
+	return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+}
+
+// testDeployment is the web Deployment, selecting its pods by app=web.
+func testDeployment(volumes ...corev1.Volume) *appsv1.Deployment {
+	labels := map[string]string{"app": "web"}
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec:       corev1.PodSpec{Volumes: volumes},
+			},
+		},
+	}
+}
+
+// podOption shapes a pod built by testPod.
+type podOption func(*corev1.Pod)
+
+// testPod builds the pod name, with nothing set but what the options add.
+func testPod(name string, options ...podOption) *corev1.Pod {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+	for _, option := range options {
+		option(pod)
+	}
+	return pod
+}
+
+func onNode(nodeName string) podOption {
+	return func(pod *corev1.Pod) {
+		pod.Spec.NodeName = nodeName
+	}
+}
+
+func inPhase(phase corev1.PodPhase) podOption {
+	return func(pod *corev1.Pod) {
+		pod.Status.Phase = phase
+	}
+}
+
+func withVolumes(volumes ...corev1.Volume) podOption {
+	return func(pod *corev1.Pod) {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, volumes...)
+	}
+}
+
+// usingClaim mounts the PVC as the pod's data volume.
+func usingClaim(claimName string) podOption {
+	return withVolumes(corev1.Volume{
+		Name:         "data",
+		VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claimName}},
+	})
+}
+
+func withLabels(labels map[string]string) podOption {
+	return func(pod *corev1.Pod) {
+		if pod.Labels == nil {
+			pod.Labels = map[string]string{}
+		}
+		for key, value := range labels {
+			pod.Labels[key] = value
+		}
+	}
+}
+
+func createdAgo(age time.Duration) podOption {
+	return func(pod *corev1.Pod) {
+		pod.CreationTimestamp = metav1.NewTime(time.Now().Add(-age))
+	}
+}
+
+// withEphemeralContainers adds the containers, with a status for the ones
+// states has one for.
+func withEphemeralContainers(states map[string]corev1.ContainerState, specs ...corev1.EphemeralContainer) podOption {
+	return func(pod *corev1.Pod) {
+		pod.Spec.EphemeralContainers = append(pod.Spec.EphemeralContainers, specs...)
+		for _, spec := range specs {
+			if state, ok := states[spec.Name]; ok {
+				pod.Status.EphemeralContainerStatuses = append(pod.Status.EphemeralContainerStatuses, corev1.ContainerStatus{Name: spec.Name, State: state})
+			}
+		}
+	}
+}
+
+// inSession tags the pod like setupPod does for a session mounted from this
+// machine.
+func inSession(t *testing.T, mountID, pvcName, mountPoint string) podOption {
+	hostName, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("Failed to get hostname: %v", err)
+	}
+	return func(pod *corev1.Pod) {
+		withLabels(map[string]string{"app": "volume-exposer", "pvcName": pvcName, MountIDLabel: mountID})(pod)
+		pod.Annotations = map[string]string{
+			MountPointAnnotation: mountPoint,
+			HostNameAnnotation:   hostName,
+		}
+	}
+}
+
+// pendingExposerPod is an exposer pod that hasn't started yet, the one
+// diagnoseTestEvent reports about.
+func pendingExposerPod() *corev1.Pod {
+	pod := testPod("volume-exposer-abcde", inPhase(corev1.PodPending))
+	pod.UID = "pod-uid"
+	return pod
+}
+
+// identityTestPod runs a database whose container overrides the UID of the
+// pod security context.
+func identityTestPod() *corev1.Pod {
+	pod := testPod("app")
+	pod.Spec.SecurityContext = &corev1.PodSecurityContext{
+		RunAsUser:          int64Ptr(1000),
+		RunAsGroup:         int64Ptr(1000),
+		FSGroup:            int64Ptr(3000),
+		SupplementalGroups: []int64{4000},
+		SELinuxOptions:     &corev1.SELinuxOptions{Level: "s0:c1,c2"},
+	}
+	pod.Spec.Containers = []corev1.Container{
+		{Name: "sidecar"},
+		{
+			Name:         "db",
+			VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/var/lib/db"}},
+			SecurityContext: &corev1.SecurityContext{
+				RunAsUser: int64Ptr(999),
+			},
+		},
+	}
+	return pod
+}
@@ -0,0 +1,107 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// foregroundMountTimeout bounds how long sshfs may take to log in and
+	// mount in foreground mode.
+	foregroundMountTimeout = 30 * time.Second
+	// foregroundExitTimeout is how long sshfs gets to exit after the unmount
+	// before it's killed.
+	foregroundExitTimeout = 10 * time.Second
+)
+
+// forwardInForeground runs the port-forward inside this process. The state
+// records our own PID, so a clean from another shell stops the whole
+// foreground mount, which then cleans up after itself.
+func forwardInForeground(ctx context.Context, restConfig *rest.Config, clientset kubernetes.Interface, state *MountState) (func(), error) {
+	localPort, stop, errs, err := forwardInProcess(ctx, restConfig, clientset, state.Namespace, state.PodName, DefaultSSHPort)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Forwarding from 127.0.0.1:%d to pod %s port %d\n", localPort, state.PodName, DefaultSSHPort)
+	state.PortForwardPID = os.Getpid()
+	state.LocalPort = localPort
+
+	go func() {
+		if err := <-errs; err != nil {
+			fmt.Printf("Warning: port-forward to pod %s stopped: %v\n", state.PodName, err)
+		}
+	}()
+	return stop, nil
+}
+
+// mountPVCOverSSHForeground starts sshfs without letting it daemonize and
+// returns once the volume is mounted. The returned channel is closed when
+// sshfs exits, and the returned function unmounts and stops it.
+func mountPVCOverSSHForeground(ctx context.Context, state *MountState, privateKey, knownHostsFile string, opts MountOptions) (<-chan struct{}, func() error, error) {
+	identity, cleanup, err := stageSessionKey(privateKey, opts.SSHAgent)
+	if err != nil {
+		return nil, nil, err
+	}
+	// sshfs only needs the key to log in
+	defer cleanup()
+
+	args := append([]string{"-f"}, buildSSHFSArgs(state.LocalPort, state.MountPoint, identity, knownHostsFile, hostKeyAlias(state.ID), remoteVolumePath(opts.SubPath), opts.NeedsRoot, opts.ReadOnly)...)
+	sshfsCmd := exec.Command("sshfs", args...)
+	sshfsCmd.Stdout = os.Stdout
+	sshfsCmd.Stderr = os.Stderr
+	// Keep Ctrl-C away from sshfs, the unmount happens in order during cleanup
+	sshfsCmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := sshfsCmd.Start(); err != nil {
+		return nil, nil, fmt.Errorf("failed to start SSHFS: %v", err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		_ = sshfsCmd.Wait()
+		close(exited)
+	}()
+
+	err = wait.PollUntilContextTimeout(ctx, 200*time.Millisecond, foregroundMountTimeout, true, func(ctx context.Context) (bool, error) {
+		select {
+		case <-exited:
+			return false, fmt.Errorf("sshfs exited before mounting")
+		default:
+		}
+		mounted, err := isMounted(state.MountPoint)
+		return err == nil && mounted, nil
+	})
+	stop := func() error {
+		return stopForegroundSSHFS(state.MountPoint, exited, sshfsCmd.Process)
+	}
+	if err != nil {
+		_ = stop()
+		return nil, nil, fmt.Errorf("failed to mount PVC using SSHFS: %v", err)
+	}
+
+	state.SSHFSPID = sshfsCmd.Process.Pid
+	fmt.Printf("%s mounted successfully to %s\n", state.source(), state.MountPoint)
+	return exited, stop, nil
+}
+
+// stopForegroundSSHFS unmounts the volume, which also clears a mount left
+// behind by an sshfs that died, and waits for sshfs to exit, killing it if it
+// doesn't.
+func stopForegroundSSHFS(localMountPoint string, exited <-chan struct{}, process *os.Process) error {
+	err := unmount(localMountPoint)
+	select {
+	case <-exited:
+	case <-time.After(foregroundExitTimeout):
+		fmt.Printf("sshfs did not exit after unmounting %s, killing it\n", localMountPoint)
+		_ = process.Kill()
+		<-exited
+	}
+	return err
+}
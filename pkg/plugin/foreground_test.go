@@ -0,0 +1,28 @@
+package plugin
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestStopForegroundSSHFSAfterExit(t *testing.T) {
+	// sshfs already gone and nothing mounted: there's nothing to kill or unmount
+	cmd := exec.Command("true")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Failed to start process: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		_ = cmd.Wait()
+		close(exited)
+	}()
+
+	if err := stopForegroundSSHFS(t.TempDir(), exited, cmd.Process); err != nil {
+		t.Errorf("stopForegroundSSHFS returned an error: %v", err)
+	}
+	select {
+	case <-exited:
+	default:
+		t.Error("Expected stopForegroundSSHFS to wait for the process")
+	}
+}
@@ -0,0 +1,519 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// Output formats of gc.
+const (
+	GCOutputTable = "table"
+	GCOutputJSON  = "json"
+)
+
+// Kinds of resources gc reports.
+const (
+	gcKindStandalone = "standalone"
+	gcKindProxy      = "proxy"
+	gcKindInspect    = "inspect"
+	gcKindEphemeral  = "ephemeral"
+	gcKindLease      = "lease"
+)
+
+// GCOptions selects what gc looks at and what it does.
+type GCOptions struct {
+	// Namespaces to search, all of them when empty.
+	Namespaces []string
+	// MaxAge, when set, makes every session older than that stale.
+	MaxAge time.Duration
+	// DryRun only reports what would be removed.
+	DryRun bool
+	// Output is GCOutputTable or GCOutputJSON.
+	Output string
+}
+
+// gcEntry is one pod, ephemeral container or leftover Lease of a session.
+type gcEntry struct {
+	Namespace string    `json:"namespace"`
+	MountID   string    `json:"mountID,omitempty"`
+	PVCName   string    `json:"pvc,omitempty"`
+	Kind      string    `json:"kind"`
+	Pod       string    `json:"pod,omitempty"`
+	Container string    `json:"container,omitempty"`
+	HostName  string    `json:"host,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	Stale     bool      `json:"stale"`
+	Reasons   []string  `json:"reasons,omitempty"`
+	Action    string    `json:"action"`
+
+	// running is only meaningful for ephemeral containers.
+	running bool
+}
+
+// gcInventory is everything pv-mounter left in one namespace.
+type gcInventory struct {
+	entries []*gcEntry
+	leases  map[string]*coordinationv1.Lease
+}
+
+// localSessions tells gc which sessions of this machine are still mounted.
+type localSessions struct {
+	hostName string
+	recorded map[string]bool
+	mounted  map[string]bool
+}
+
+// GC finds the sessions pv-mounter left behind in the selected namespaces
+// and removes the stale ones. A session is stale when its Lease expired, when
+// this machine recorded mounting it but no longer has it mounted, or when
+// it's older than opts.MaxAge. Progress goes to out, or to stderr when out
+// gets JSON.
+func GC(ctx context.Context, configFlags *genericclioptions.ConfigFlags, opts GCOptions, out io.Writer) error {
+	if opts.Output == "" {
+		opts.Output = GCOutputTable
+	}
+	if opts.Output != GCOutputTable && opts.Output != GCOutputJSON {
+		return fmt.Errorf("unknown output format %q, use %s or %s", opts.Output, GCOutputTable, GCOutputJSON)
+	}
+	// Keep the progress messages out of the JSON document
+	progress := out
+	if opts.Output == GCOutputJSON {
+		progress = os.Stderr
+	}
+
+	clientset, restConfig, err := BuildKubeClient(configFlags)
+	if err != nil {
+		return err
+	}
+	local, err := loadLocalSessions()
+	if err != nil {
+		return err
+	}
+
+	namespaces := opts.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+
+	var entries []*gcEntry
+	var failed []string
+	for _, namespace := range namespaces {
+		inventory, err := collectInventory(ctx, clientset, namespace, progress)
+		if err != nil {
+			return err
+		}
+		judgeSessions(inventory, local, opts.MaxAge, time.Now())
+		failed = append(failed, removeStale(ctx, restConfig, clientset, inventory.entries, local, opts.DryRun, progress)...)
+		entries = append(entries, inventory.entries...)
+	}
+
+	if err := printGC(out, entries, opts.Output); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to remove %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// loadLocalSessions reads the mounts recorded on this machine and checks
+// which of them are still mounted.
+func loadLocalSessions() (*localSessions, error) {
+	hostName, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("failed to determine hostname: %v", err)
+	}
+	states, err := loadMountStates()
+	if err != nil {
+		return nil, err
+	}
+	local := &localSessions{hostName: hostName, recorded: map[string]bool{}, mounted: map[string]bool{}}
+	for _, state := range states {
+		local.recorded[state.ID] = true
+		if mounted, err := isMounted(state.MountPoint); err == nil && mounted {
+			local.mounted[state.ID] = true
+		}
+	}
+	return local, nil
+}
+
+// collectInventory lists the exposer, proxy and inspection pods, the
+// pv-mounter ephemeral containers in the pods the proxies tunnel to and the
+// session Leases in namespace.
+// Without access to Leases, sessions are judged without them.
+func collectInventory(ctx context.Context, clientset kubernetes.Interface, namespace string, out io.Writer) (*gcInventory, error) {
+	inventory := &gcInventory{leases: map[string]*coordinationv1.Lease{}}
+
+	leases, err := clientset.CoordinationV1().Leases(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "app=volume-exposer",
+	})
+	switch {
+	case apierrors.IsForbidden(err):
+		fmt.Fprintf(out, "Warning: not allowed to list Leases (%v), judging sessions without them\n", err)
+		leases = &coordinationv1.LeaseList{}
+	case err != nil:
+		return nil, fmt.Errorf("failed to list leases: %v", err)
+	}
+	for i := range leases.Items {
+		lease := &leases.Items[i]
+		if mountID := lease.Labels[MountIDLabel]; mountID != "" {
+			inventory.leases[sessionKey(lease.Namespace, mountID)] = lease
+		}
+	}
+
+	pods, err := listSessionPods(ctx, clientset, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	// Proxy pods record which ephemeral container they're tunnelled to
+	proxies := map[string]*corev1.Pod{}
+	withPods := map[string]bool{}
+	for i := range pods {
+		pod := &pods[i]
+		entry := &gcEntry{
+			Namespace: pod.Namespace,
+			MountID:   pod.Labels[MountIDLabel],
+			PVCName:   pod.Labels["pvcName"],
+			Kind:      podKind(pod),
+			Pod:       pod.Name,
+			HostName:  pod.Annotations[HostNameAnnotation],
+			CreatedAt: pod.CreationTimestamp.Time,
+		}
+		inventory.entries = append(inventory.entries, entry)
+		withPods[sessionKey(pod.Namespace, entry.MountID)] = true
+		if container := pod.Annotations[EphemeralContainerAnnotation]; container != "" {
+			proxies[sessionKey(pod.Namespace, container)] = pod
+		}
+	}
+
+	targets, err := proxyTargets(ctx, clientset, pods)
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range targets {
+		for _, container := range pod.Spec.EphemeralContainers {
+			if !strings.HasPrefix(container.Name, EphemeralContainerPrefix) {
+				continue
+			}
+			entry := &gcEntry{
+				Namespace: pod.Namespace,
+				Kind:      gcKindEphemeral,
+				Pod:       pod.Name,
+				Container: container.Name,
+				CreatedAt: ephemeralContainerStarted(pod, container.Name),
+				running:   ephemeralContainerRunning(pod, container.Name),
+			}
+			if proxy := proxies[sessionKey(pod.Namespace, container.Name)]; proxy != nil {
+				entry.MountID = proxy.Labels[MountIDLabel]
+				entry.PVCName = proxy.Labels["pvcName"]
+				entry.HostName = proxy.Annotations[HostNameAnnotation]
+				entry.CreatedAt = proxy.CreationTimestamp.Time
+			}
+			inventory.entries = append(inventory.entries, entry)
+		}
+	}
+
+	// A Lease whose pods are gone is a leftover too
+	for key, lease := range inventory.leases {
+		if withPods[key] {
+			continue
+		}
+		inventory.entries = append(inventory.entries, &gcEntry{
+			Namespace: lease.Namespace,
+			MountID:   lease.Labels[MountIDLabel],
+			PVCName:   lease.Labels["pvcName"],
+			Kind:      gcKindLease,
+			CreatedAt: lease.CreationTimestamp.Time,
+		})
+	}
+
+	sort.SliceStable(inventory.entries, func(i, j int) bool {
+		a, b := inventory.entries[i], inventory.entries[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.MountID != b.MountID {
+			return a.MountID < b.MountID
+		}
+		return a.Kind < b.Kind
+	})
+	return inventory, nil
+}
+
+// listSessionPods lists the pods pv-mounter created in namespace, page by
+// page.
+func listSessionPods(ctx context.Context, clientset kubernetes.Interface, namespace string) ([]corev1.Pod, error) {
+	var pods []corev1.Pod
+	options := metav1.ListOptions{LabelSelector: "app=volume-exposer", Limit: listPageSize}
+	for {
+		podList, err := clientset.CoreV1().Pods(namespace).List(ctx, options)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list pods: %v", err)
+		}
+		pods = append(pods, podList.Items...)
+		if podList.Continue == "" {
+			return pods, nil
+		}
+		options.Continue = podList.Continue
+	}
+}
+
+// proxyTargets gets the workload pods the proxy pods among pods tunnel to,
+// which is where the ephemeral containers live. Those carry no label of
+// ours; the ones no session points to anymore stop by themselves once idle.
+func proxyTargets(ctx context.Context, clientset kubernetes.Interface, pods []corev1.Pod) ([]*corev1.Pod, error) {
+	var targets []*corev1.Pod
+	seen := map[string]bool{}
+	for i := range pods {
+		name := pods[i].Labels["originalPodName"]
+		key := sessionKey(pods[i].Namespace, name)
+		if name == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		target, err := clientset.CoreV1().Pods(pods[i].Namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get pod %s: %v", name, err)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+func sessionKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+func podKind(pod *corev1.Pod) string {
+	switch {
+	case pod.Labels["originalPodName"] != "":
+		return gcKindProxy
+	case strings.HasPrefix(pod.Name, "volume-exposer-inspect-"):
+		return gcKindInspect
+	default:
+		return gcKindStandalone
+	}
+}
+
+// ephemeralContainerStarted is when the container started running, or the
+// pod's creation when it never did.
+func ephemeralContainerStarted(pod *corev1.Pod, name string) time.Time {
+	for _, status := range pod.Status.EphemeralContainerStatuses {
+		if status.Name == name && status.State.Running != nil {
+			return status.State.Running.StartedAt.Time
+		}
+	}
+	return pod.CreationTimestamp.Time
+}
+
+func ephemeralContainerRunning(pod *corev1.Pod, name string) bool {
+	for _, status := range pod.Status.EphemeralContainerStatuses {
+		if status.Name == name {
+			return status.State.Running != nil
+		}
+	}
+	return false
+}
+
+// judgeSessions decides which entries are stale. All entries of a session
+// share the verdict, so a session is never half removed.
+func judgeSessions(inventory *gcInventory, local *localSessions, maxAge time.Duration, now time.Time) {
+	reasons := map[string][]string{}
+	for _, entry := range inventory.entries {
+		if entry.MountID == "" {
+			continue
+		}
+		key := sessionKey(entry.Namespace, entry.MountID)
+		if _, seen := reasons[key]; seen {
+			continue
+		}
+		var why []string
+		if lease := inventory.leases[key]; lease != nil && leaseExpired(lease, now) {
+			why = append(why, "lease expired")
+		}
+		// Only a mount this machine recorded can be known to be gone: other
+		// machines may share the hostname, and a mount still being set up
+		// isn't recorded yet. The Lease covers everything else.
+		if entry.HostName == local.hostName && local.recorded[entry.MountID] && !local.mounted[entry.MountID] {
+			why = append(why, "not mounted here anymore")
+		}
+		reasons[key] = why
+	}
+
+	for _, entry := range inventory.entries {
+		var why []string
+		if entry.MountID != "" {
+			why = append(why, reasons[sessionKey(entry.Namespace, entry.MountID)]...)
+		}
+		if maxAge > 0 && now.Sub(entry.CreatedAt) > maxAge {
+			why = append(why, fmt.Sprintf("older than %s", maxAge))
+		}
+		entry.Reasons = why
+		entry.Stale = len(why) > 0
+	}
+
+	// Age is judged per entry, spread it to the rest of the session
+	staleSessions := map[string]bool{}
+	for _, entry := range inventory.entries {
+		if entry.Stale && entry.MountID != "" {
+			staleSessions[sessionKey(entry.Namespace, entry.MountID)] = true
+		}
+	}
+	for _, entry := range inventory.entries {
+		if !entry.Stale && entry.MountID != "" && staleSessions[sessionKey(entry.Namespace, entry.MountID)] {
+			entry.Stale = true
+			entry.Reasons = []string{"rest of the session is stale"}
+		}
+	}
+}
+
+// removeStale removes the stale sessions and records the outcome on every
+// entry, reporting progress to out. It returns what couldn't be removed.
+func removeStale(ctx context.Context, restConfig *rest.Config, clientset kubernetes.Interface, entries []*gcEntry, local *localSessions, dryRun bool, out io.Writer) []string {
+	var failed []string
+	done := map[string]error{}
+	for _, entry := range entries {
+		switch {
+		case !entry.Stale && entry.Kind == gcKindEphemeral && entry.MountID == "" && entry.running:
+			// Detached by clean, the next mount of the pod reuses it
+			entry.Action = "idle"
+			continue
+		case !entry.Stale:
+			entry.Action = "kept"
+			continue
+		case entry.Kind == gcKindEphemeral && !entry.running:
+			// Kubernetes can't remove ephemeral containers, only the pod
+			entry.Action = "already stopped"
+			continue
+		case dryRun:
+			entry.Action = "would remove"
+			continue
+		}
+
+		var err error
+		switch {
+		case entry.MountID != "":
+			key := sessionKey(entry.Namespace, entry.MountID)
+			var seen bool
+			if err, seen = done[key]; !seen {
+				err = removeSession(ctx, restConfig, clientset, entry.Namespace, entry.MountID, out)
+				if err == nil && local.recorded[entry.MountID] {
+					err = removeMountState(entry.MountID)
+				}
+				done[key] = err
+			}
+		case entry.Kind == gcKindEphemeral:
+			err = killProcessInEphemeralContainer(ctx, restConfig, clientset, entry.Namespace, entry.Pod, entry.Container, out)
+		default:
+			// Pods from before sessions were tagged
+			err = deletePod(ctx, clientset, entry.Namespace, entry.Pod, out)
+		}
+
+		if err != nil {
+			entry.Action = "failed"
+			fmt.Fprintf(out, "Warning: %v\n", err)
+			failed = append(failed, gcEntryName(entry))
+			continue
+		}
+		entry.Action = "removed"
+	}
+	return failed
+}
+
+// removeSession cleans up every pod of the session, and the Secret and Lease
+// even when no pod is left.
+func removeSession(ctx context.Context, restConfig *rest.Config, clientset kubernetes.Interface, namespace, mountID string, out io.Writer) error {
+	pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", MountIDLabel, mountID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list pods of session %s: %v", mountID, err)
+	}
+
+	states := make([]*MountState, 0, len(pods.Items))
+	for i := range pods.Items {
+		states = append(states, sessionFromPod(&pods.Items[i]))
+	}
+	if len(states) == 0 {
+		states = append(states, &MountState{ID: mountID, Namespace: namespace})
+	}
+
+	for _, state := range states {
+		if state.TargetPodName != "" {
+			// Nothing to stop if the workload pod went away meanwhile
+			_, err := clientset.CoreV1().Pods(namespace).Get(ctx, state.TargetPodName, metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				state.TargetPodName = ""
+			}
+		}
+		if err := cleanSession(ctx, restConfig, clientset, state, out); err != nil {
+			return fmt.Errorf("failed to clean session %s: %v", mountID, err)
+		}
+	}
+	return nil
+}
+
+func gcEntryName(entry *gcEntry) string {
+	if entry.MountID != "" {
+		return fmt.Sprintf("session %s/%s", entry.Namespace, entry.MountID)
+	}
+	if entry.Container != "" {
+		return fmt.Sprintf("container %s/%s/%s", entry.Namespace, entry.Pod, entry.Container)
+	}
+	return fmt.Sprintf("pod %s/%s", entry.Namespace, entry.Pod)
+}
+
+func printGC(out io.Writer, entries []*gcEntry, output string) error {
+	if output == GCOutputJSON {
+		if entries == nil {
+			entries = []*gcEntry{}
+		}
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+
+	if len(entries) == 0 {
+		fmt.Fprintln(out, "No pv-mounter resources found")
+		return nil
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tSESSION\tPVC\tKIND\tPOD\tCONTAINER\tHOST\tAGE\tSTALE\tACTION")
+	for _, entry := range entries {
+		stale := "no"
+		if entry.Stale {
+			stale = strings.Join(entry.Reasons, ", ")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			entry.Namespace, dash(entry.MountID), dash(entry.PVCName), entry.Kind, dash(entry.Pod),
+			dash(entry.Container), dash(entry.HostName), duration.HumanDuration(time.Since(entry.CreatedAt)), stale, entry.Action)
+	}
+	return w.Flush()
+}
+
+func dash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
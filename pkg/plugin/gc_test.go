@@ -0,0 +1,232 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func gcTestObjects(now time.Time) []runtime.Object {
+	exposer := func(name, mountID, host string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name: name, Namespace: "default",
+			CreationTimestamp: metav1.NewTime(now.Add(-time.Hour)),
+			Labels:            map[string]string{"app": "volume-exposer", "pvcName": "data", MountIDLabel: mountID},
+			Annotations:       map[string]string{HostNameAnnotation: host},
+		}}
+	}
+	lease := func(mountID string, renewed time.Time) *coordinationv1.Lease {
+		renewTime := metav1.NewMicroTime(renewed)
+		durationSeconds := int32(leaseDuration.Seconds())
+		return &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: sessionLeaseName(mountID), Namespace: "default",
+				Labels: map[string]string{"app": "volume-exposer", MountIDLabel: mountID},
+			},
+			Spec: coordinationv1.LeaseSpec{RenewTime: &renewTime, LeaseDurationSeconds: &durationSeconds},
+		}
+	}
+
+	return []runtime.Object{
+		exposer("volume-exposer-stale", "stale", "laptop"),
+		lease("stale", now.Add(-time.Hour)),
+		exposer("volume-exposer-alive", "alive", "laptop"),
+		lease("alive", now),
+		exposer("volume-exposer-mine", "mine", "this-host"),
+		lease("mine", now),
+		lease("leftover", now.Add(-time.Hour)),
+	}
+}
+
+func entriesByName(entries []*gcEntry) map[string]*gcEntry {
+	byName := map[string]*gcEntry{}
+	for _, entry := range entries {
+		name := entry.Pod + entry.Container
+		if entry.Kind == gcKindLease {
+			name = "lease/" + entry.MountID
+		}
+		byName[name] = entry
+	}
+	return byName
+}
+
+func TestGCJudgesSessions(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	// Being set up on this machine, so not recorded yet
+	setup := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name: "volume-exposer-setup", Namespace: "default",
+		CreationTimestamp: metav1.NewTime(now),
+		Labels:            map[string]string{"app": "volume-exposer", "pvcName": "data", MountIDLabel: "setup"},
+		Annotations:       map[string]string{HostNameAnnotation: "this-host"},
+	}}
+	// The ephemeral containers are found through the proxy pod of a session
+	proxy := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name: "volume-exposer-proxy", Namespace: "default",
+		CreationTimestamp: metav1.NewTime(now),
+		Labels:            map[string]string{"app": "volume-exposer", "pvcName": "data", MountIDLabel: "alive", "originalPodName": "app"},
+		Annotations:       map[string]string{HostNameAnnotation: "laptop", EphemeralContainerAnnotation: "volume-exposer-ephemeral-live1"},
+	}}
+	running := corev1.ContainerState{Running: &corev1.ContainerStateRunning{StartedAt: metav1.NewTime(now.Add(-time.Hour))}}
+	objects := append(gcTestObjects(now), setup, proxy, &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: corev1.PodSpec{EphemeralContainers: []corev1.EphemeralContainer{
+			{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "volume-exposer-ephemeral-live1"}},
+			{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "volume-exposer-ephemeral-idle1"}},
+			{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "volume-exposer-ephemeral-done1"}},
+		}},
+		Status: corev1.PodStatus{EphemeralContainerStatuses: []corev1.ContainerStatus{
+			{Name: "volume-exposer-ephemeral-live1", State: running},
+			{Name: "volume-exposer-ephemeral-idle1", State: running},
+			{Name: "volume-exposer-ephemeral-done1", State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{}}},
+		}},
+	})
+	clientset := fake.NewSimpleClientset(objects...)
+	local := &localSessions{hostName: "this-host", recorded: map[string]bool{"mine": true}, mounted: map[string]bool{}}
+
+	inventory, err := collectInventory(ctx, clientset, "default", io.Discard)
+	if err != nil {
+		t.Fatalf("collectInventory() returned error: %v", err)
+	}
+	judgeSessions(inventory, local, 0, now)
+	if failed := removeStale(ctx, &rest.Config{}, clientset, inventory.entries, local, true, io.Discard); len(failed) != 0 {
+		t.Errorf("Expected a dry run not to fail, got %v", failed)
+	}
+
+	want := map[string]string{
+		"volume-exposer-stale":              "would remove",
+		"volume-exposer-alive":              "kept",
+		"volume-exposer-mine":               "would remove",
+		"volume-exposer-setup":              "kept",
+		"volume-exposer-proxy":              "kept",
+		"appvolume-exposer-ephemeral-live1": "kept",
+		"lease/leftover":                    "would remove",
+		"appvolume-exposer-ephemeral-idle1": "idle",
+		"appvolume-exposer-ephemeral-done1": "kept",
+	}
+	got := entriesByName(inventory.entries)
+	if len(got) != len(want) {
+		t.Errorf("Expected %d entries, got %d", len(want), len(got))
+	}
+	for name, action := range want {
+		entry, ok := got[name]
+		if !ok {
+			t.Errorf("Missing entry %s", name)
+			continue
+		}
+		if entry.Action != action {
+			t.Errorf("Expected %s for %s, got %s (%v)", action, name, entry.Action, entry.Reasons)
+		}
+	}
+
+	pods, err := clientset.CoreV1().Pods("default").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("Failed to list pods: %v", err)
+	}
+	if len(pods.Items) != 6 {
+		t.Errorf("Expected a dry run to keep all pods, got %d", len(pods.Items))
+	}
+
+	// Age alone makes the live session stale too, and stops idle containers
+	judgeSessions(inventory, local, 30*time.Minute, now)
+	if entry := got["volume-exposer-alive"]; !entry.Stale {
+		t.Errorf("Expected an hour old session to be stale with --max-age 30m, got %v", entry.Reasons)
+	}
+	if entry := got["appvolume-exposer-ephemeral-idle1"]; !entry.Stale {
+		t.Errorf("Expected a container idle for an hour to be stale with --max-age 30m, got %v", entry.Reasons)
+	}
+}
+
+func TestGCRemovesStaleSessions(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	clientset := fake.NewSimpleClientset(gcTestObjects(now)...)
+	local := &localSessions{hostName: "this-host", recorded: map[string]bool{"mine": true}, mounted: map[string]bool{"mine": true}}
+
+	inventory, err := collectInventory(ctx, clientset, "default", io.Discard)
+	if err != nil {
+		t.Fatalf("collectInventory() returned error: %v", err)
+	}
+	judgeSessions(inventory, local, 0, now)
+	var progress bytes.Buffer
+	if failed := removeStale(ctx, &rest.Config{}, clientset, inventory.entries, local, false, &progress); len(failed) != 0 {
+		t.Fatalf("removeStale() failed for %v", failed)
+	}
+	if !strings.Contains(progress.String(), "Pod volume-exposer-stale deleted successfully") {
+		t.Errorf("Expected the progress to go to the given writer, got %q", progress.String())
+	}
+
+	pods, err := clientset.CoreV1().Pods("default").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("Failed to list pods: %v", err)
+	}
+	var podNames []string
+	for _, pod := range pods.Items {
+		podNames = append(podNames, pod.Name)
+	}
+	if len(podNames) != 2 {
+		t.Errorf("Expected the live sessions' pods to remain, got %v", podNames)
+	}
+	leases, err := clientset.CoordinationV1().Leases("default").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("Failed to list leases: %v", err)
+	}
+	if len(leases.Items) != 2 {
+		t.Errorf("Expected the live sessions' leases to remain, got %d", len(leases.Items))
+	}
+}
+
+func TestListSessionPods(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	// The fake drops Limit and Continue, so the pages are told apart by count
+	labels := map[string]string{"app": "volume-exposer"}
+	var selectors []string
+	clientset.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		selectors = append(selectors, action.(k8stesting.ListAction).GetListRestrictions().Labels.String())
+		switch len(selectors) {
+		case 1:
+			return true, &corev1.PodList{ListMeta: metav1.ListMeta{Continue: "page-2"}, Items: []corev1.Pod{{ObjectMeta: metav1.ObjectMeta{Name: "volume-exposer-a", Labels: labels}}}}, nil
+		case 2:
+			return true, &corev1.PodList{Items: []corev1.Pod{{ObjectMeta: metav1.ObjectMeta{Name: "volume-exposer-b", Labels: labels}}}}, nil
+		}
+		return true, nil, errors.New("listed past the last page")
+	})
+
+	pods, err := listSessionPods(ctx, clientset, metav1.NamespaceAll)
+	if err != nil {
+		t.Fatalf("listSessionPods() returned error: %v", err)
+	}
+	if len(pods) != 2 {
+		t.Errorf("Expected the pods of both pages, got %d", len(pods))
+	}
+	for _, selector := range selectors {
+		if selector != "app=volume-exposer" {
+			t.Errorf("Expected only session pods to be listed, got selector %q", selector)
+		}
+	}
+}
+
+func TestPrintGCJSON(t *testing.T) {
+	var out bytes.Buffer
+	if err := printGC(&out, nil, GCOutputJSON); err != nil {
+		t.Fatalf("printGC() returned error: %v", err)
+	}
+	var entries []gcEntry
+	if err := json.Unmarshal(out.Bytes(), &entries); err != nil || entries == nil {
+		t.Errorf("Expected an empty JSON list, got %q (%v)", out.String(), err)
+	}
+}
@@ -0,0 +1,120 @@
+package plugin
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// containerIdentity is the identity the ephemeral container borrows from the
+// container that already mounts the volume.
+type containerIdentity struct {
+	containerName  string
+	runAsUser      *int64
+	runAsGroup     *int64
+	seLinuxOptions *corev1.SELinuxOptions
+	// fsGroup and supplementalGroups are pod-wide, so the ephemeral container
+	// gets them anyway. They're only kept to tell the user.
+	fsGroup            *int64
+	supplementalGroups []int64
+}
+
+// targetIdentity resolves the effective identity of the first container in
+// the pod that mounts volumeName. Container settings win over the pod's, the
+// same way the kubelet applies them.
+func targetIdentity(pod *corev1.Pod, volumeName string) (*containerIdentity, error) {
+	container := findContainerMounting(pod, volumeName)
+	if container == nil {
+		return nil, fmt.Errorf("no container in pod %s mounts volume %s", pod.Name, volumeName)
+	}
+
+	identity := &containerIdentity{containerName: container.Name}
+	if podSC := pod.Spec.SecurityContext; podSC != nil {
+		identity.runAsUser = podSC.RunAsUser
+		identity.runAsGroup = podSC.RunAsGroup
+		identity.seLinuxOptions = podSC.SELinuxOptions
+		identity.fsGroup = podSC.FSGroup
+		identity.supplementalGroups = podSC.SupplementalGroups
+	}
+	if sc := container.SecurityContext; sc != nil {
+		if sc.RunAsUser != nil {
+			identity.runAsUser = sc.RunAsUser
+		}
+		if sc.RunAsGroup != nil {
+			identity.runAsGroup = sc.RunAsGroup
+		}
+		if sc.SELinuxOptions != nil {
+			identity.seLinuxOptions = sc.SELinuxOptions
+		}
+	}
+	return identity, nil
+}
+
+func findContainerMounting(pod *corev1.Pod, volumeName string) *corev1.Container {
+	for i, container := range pod.Spec.Containers {
+		for _, mount := range container.VolumeMounts {
+			if mount.Name == volumeName {
+				return &pod.Spec.Containers[i]
+			}
+		}
+	}
+	return nil
+}
+
+// checkIdentity makes sure the borrowed UID fits the image: sshd refuses root
+// logins in the standard image and the privileged one only logs in as root.
+func checkIdentity(identity *containerIdentity, needsRoot bool) error {
+	if identity.runAsUser == nil {
+		return nil
+	}
+	uid := *identity.runAsUser
+	if uid == 0 && !needsRoot {
+		return fmt.Errorf("container %s runs as root, use --needs-root together with --inherit-identity", identity.containerName)
+	}
+	if uid != 0 && needsRoot {
+		return fmt.Errorf("container %s runs as UID %d, drop --needs-root to inherit its identity", identity.containerName, uid)
+	}
+	return nil
+}
+
+// describe summarizes the identity for the progress output.
+func (id *containerIdentity) describe() string {
+	desc := fmt.Sprintf("container %s", id.containerName)
+	if id.runAsUser != nil {
+		desc += fmt.Sprintf(", UID %d", *id.runAsUser)
+	} else {
+		desc += ", image default UID"
+	}
+	if id.runAsGroup != nil {
+		desc += fmt.Sprintf(", GID %d", *id.runAsGroup)
+	}
+	if id.fsGroup != nil {
+		desc += fmt.Sprintf(", fsGroup %d", *id.fsGroup)
+	}
+	if len(id.supplementalGroups) > 0 {
+		desc += fmt.Sprintf(", supplemental groups %v", id.supplementalGroups)
+	}
+	if id.seLinuxOptions != nil {
+		desc += fmt.Sprintf(", SELinux %s:%s:%s:%s", id.seLinuxOptions.User, id.seLinuxOptions.Role, id.seLinuxOptions.Type, id.seLinuxOptions.Level)
+	}
+	return desc
+}
+
+// apply copies the identity onto the ephemeral container and targets the
+// container it came from, so both share a process namespace.
+func (id *containerIdentity) apply(container *corev1.EphemeralContainer) {
+	container.TargetContainerName = id.containerName
+
+	sc := container.SecurityContext
+	if sc == nil {
+		sc = &corev1.SecurityContext{}
+		container.SecurityContext = sc
+	}
+	sc.RunAsUser = id.runAsUser
+	sc.RunAsGroup = id.runAsGroup
+	sc.SELinuxOptions = id.seLinuxOptions
+	if id.runAsUser != nil && *id.runAsUser != 0 {
+		runAsNonRoot := true
+		sc.RunAsNonRoot = &runAsNonRoot
+	}
+}
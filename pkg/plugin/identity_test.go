@@ -0,0 +1,77 @@
+package plugin
+
+import (
+	"testing"
+)
+
+func TestTargetIdentity(t *testing.T) {
+	identity, err := targetIdentity(identityTestPod(), "data")
+	if err != nil {
+		t.Fatalf("targetIdentity() returned error: %v", err)
+	}
+	if identity.containerName != "db" {
+		t.Errorf("Expected container db, got %s", identity.containerName)
+	}
+	if *identity.runAsUser != 999 {
+		t.Errorf("Expected the container UID 999 to win, got %d", *identity.runAsUser)
+	}
+	if *identity.runAsGroup != 1000 {
+		t.Errorf("Expected the pod GID 1000, got %d", *identity.runAsGroup)
+	}
+	if identity.seLinuxOptions == nil || identity.seLinuxOptions.Level != "s0:c1,c2" {
+		t.Errorf("Expected the pod SELinux level, got %+v", identity.seLinuxOptions)
+	}
+
+	if _, err := targetIdentity(identityTestPod(), "missing"); err == nil {
+		t.Error("Expected an error for a volume no container mounts")
+	}
+}
+
+func TestCheckIdentity(t *testing.T) {
+	tests := []struct {
+		name      string
+		uid       *int64
+		needsRoot bool
+		wantErr   bool
+	}{
+		{name: "unset", uid: nil},
+		{name: "non-root", uid: int64Ptr(999)},
+		{name: "root without needs-root", uid: int64Ptr(0), wantErr: true},
+		{name: "root with needs-root", uid: int64Ptr(0), needsRoot: true},
+		{name: "non-root with needs-root", uid: int64Ptr(999), needsRoot: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkIdentity(&containerIdentity{containerName: "db", runAsUser: tt.uid}, tt.needsRoot)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkIdentity() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCreateEphemeralContainerSpecIdentity(t *testing.T) {
+	identity, err := targetIdentity(identityTestPod(), "data")
+	if err != nil {
+		t.Fatalf("targetIdentity() returned error: %v", err)
+	}
+	container := createEphemeralContainerSpec("volume-exposer-ephemeral-abcde", "data", "volume-exposer-abcdefgh", "10.0.0.1", identity, false, false)
+	if container.TargetContainerName != "db" {
+		t.Errorf("Expected target container db, got %q", container.TargetContainerName)
+	}
+	sc := container.SecurityContext
+	if sc.RunAsUser == nil || *sc.RunAsUser != 999 || sc.RunAsGroup == nil || *sc.RunAsGroup != 1000 {
+		t.Errorf("Expected to run as 999:1000, got %+v", sc)
+	}
+	if sc.RunAsNonRoot == nil || !*sc.RunAsNonRoot {
+		t.Error("Expected runAsNonRoot to be set")
+	}
+	if sc.Capabilities == nil || len(sc.Capabilities.Drop) == 0 {
+		t.Error("Expected the default capability restrictions to be kept")
+	}
+
+	container = createEphemeralContainerSpec("volume-exposer-ephemeral-abcde", "data", "volume-exposer-abcdefgh", "10.0.0.1", nil, false, false)
+	if container.TargetContainerName != "" || container.SecurityContext.RunAsUser != nil {
+		t.Errorf("Expected the image identity without --inherit-identity, got %+v", container)
+	}
+}
@@ -0,0 +1,169 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// agentKeyLifetime bounds how long a running ssh-agent keeps the session key
+// if pv-mounter dies before removing it. sshfs only needs it to log in.
+const agentKeyLifetime = 120
+
+// sshIdentity tells ssh where to find the session key.
+type sshIdentity struct {
+	// file is a private key file.
+	file string
+	// agent is the socket of an agent holding the key.
+	agent string
+	// publicKey is a file with the public half of the key in the agent, so
+	// ssh offers only that one of the keys the agent holds.
+	publicKey string
+}
+
+func (i sshIdentity) options() []string {
+	if i.agent != "" && i.publicKey != "" {
+		return []string{
+			"-o", fmt.Sprintf("IdentityAgent=%s", i.agent),
+			"-o", "IdentitiesOnly=yes",
+			"-o", fmt.Sprintf("IdentityFile=%s", i.publicKey),
+		}
+	}
+	if i.agent != "" {
+		return []string{"-o", fmt.Sprintf("IdentityAgent=%s", i.agent)}
+	}
+	return []string{"-o", fmt.Sprintf("IdentityFile=%s", i.file)}
+}
+
+// stageSessionKey makes the private key available to sshfs. With useAgent
+// it goes to the running ssh-agent, or to an agent served by pv-mounter when
+// there's none, and never touches the disk. The returned function undoes it.
+func stageSessionKey(privateKey string, useAgent bool) (sshIdentity, func(), error) {
+	if !useAgent {
+		return stageKeyFile(privateKey)
+	}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		return stageRunningAgent(privateKey, sock)
+	}
+	return stageBuiltinAgent(privateKey)
+}
+
+// stageKeyFile writes the key to a 0600 file in a private directory, which
+// the returned function removes. Mount runs it on every exit path: signals
+// only cancel its context, they don't kill the process.
+func stageKeyFile(privateKey string) (sshIdentity, func(), error) {
+	dir, err := os.MkdirTemp("", "pv-mounter-")
+	if err != nil {
+		return sshIdentity{}, nil, fmt.Errorf("failed to create temporary directory for SSH private key: %v", err)
+	}
+	cleanup := func() {
+		os.RemoveAll(dir)
+	}
+
+	path := filepath.Join(dir, "id")
+	if err := os.WriteFile(path, []byte(privateKey), 0600); err != nil {
+		cleanup()
+		return sshIdentity{}, nil, fmt.Errorf("failed to write SSH private key to temporary file: %v", err)
+	}
+	return sshIdentity{file: path}, cleanup, nil
+}
+
+// stageRunningAgent adds the key to the agent at sock with a lifetime, and
+// removes it again on cleanup. The agent may hold plenty of the user's own
+// keys, and offering them all first can run into the server's MaxAuthTries,
+// so the public key goes to a file that pins ssh to the session key.
+func stageRunningAgent(privateKey, sock string) (sshIdentity, func(), error) {
+	rawKey, err := ssh.ParseRawPrivateKey([]byte(privateKey))
+	if err != nil {
+		return sshIdentity{}, nil, fmt.Errorf("failed to parse SSH private key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(rawKey)
+	if err != nil {
+		return sshIdentity{}, nil, fmt.Errorf("failed to parse SSH private key: %v", err)
+	}
+
+	dir, err := os.MkdirTemp("", "pv-mounter-")
+	if err != nil {
+		return sshIdentity{}, nil, fmt.Errorf("failed to create temporary directory for SSH public key: %v", err)
+	}
+	publicKey := filepath.Join(dir, "id.pub")
+	if err := os.WriteFile(publicKey, ssh.MarshalAuthorizedKey(signer.PublicKey()), 0600); err != nil {
+		os.RemoveAll(dir)
+		return sshIdentity{}, nil, fmt.Errorf("failed to write SSH public key to temporary file: %v", err)
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		os.RemoveAll(dir)
+		return sshIdentity{}, nil, fmt.Errorf("failed to connect to ssh-agent: %v", err)
+	}
+	client := agent.NewClient(conn)
+	err = client.Add(agent.AddedKey{
+		PrivateKey:   rawKey,
+		Comment:      "pv-mounter session key",
+		LifetimeSecs: agentKeyLifetime,
+	})
+	if err != nil {
+		conn.Close()
+		os.RemoveAll(dir)
+		return sshIdentity{}, nil, fmt.Errorf("failed to add SSH key to ssh-agent: %v", err)
+	}
+	fmt.Printf("Added the session key to ssh-agent for %d seconds\n", agentKeyLifetime)
+
+	cleanup := func() {
+		if err := client.Remove(signer.PublicKey()); err != nil {
+			fmt.Printf("Warning: failed to remove the session key from ssh-agent: %v\n", err)
+		}
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+	return sshIdentity{agent: sock, publicKey: publicKey}, cleanup, nil
+}
+
+// stageBuiltinAgent serves the key from memory over a Unix socket in a
+// private directory, for as long as it takes sshfs to log in.
+func stageBuiltinAgent(privateKey string) (sshIdentity, func(), error) {
+	rawKey, err := ssh.ParseRawPrivateKey([]byte(privateKey))
+	if err != nil {
+		return sshIdentity{}, nil, fmt.Errorf("failed to parse SSH private key: %v", err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: rawKey, Comment: "pv-mounter session key"}); err != nil {
+		return sshIdentity{}, nil, fmt.Errorf("failed to load SSH key into agent: %v", err)
+	}
+
+	dir, err := os.MkdirTemp("", "pv-mounter-")
+	if err != nil {
+		return sshIdentity{}, nil, fmt.Errorf("failed to create temporary directory for agent socket: %v", err)
+	}
+	sock := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		os.RemoveAll(dir)
+		return sshIdentity{}, nil, fmt.Errorf("failed to listen on agent socket: %v", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	cleanup := func() {
+		listener.Close()
+		keyring.RemoveAll()
+		os.RemoveAll(dir)
+	}
+	return sshIdentity{agent: sock}, cleanup, nil
+}
@@ -0,0 +1,129 @@
+package plugin
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func listAgentKeys(t *testing.T, sock string) []*agent.Key {
+	t.Helper()
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatalf("Failed to connect to agent: %v", err)
+	}
+	defer conn.Close()
+	keys, err := agent.NewClient(conn).List()
+	if err != nil {
+		t.Fatalf("Failed to list agent keys: %v", err)
+	}
+	return keys
+}
+
+func TestStageKeyFile(t *testing.T) {
+	privateKey, _, err := GenerateKeyPair(KeyTypeEd25519)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair returned an error: %v", err)
+	}
+
+	identity, cleanup, err := stageSessionKey(privateKey, false)
+	if err != nil {
+		t.Fatalf("stageSessionKey returned an error: %v", err)
+	}
+	info, err := os.Stat(identity.file)
+	if err != nil {
+		t.Fatalf("Key file missing: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected key file mode 0600, got %v", info.Mode().Perm())
+	}
+	dirInfo, err := os.Stat(filepath.Dir(identity.file))
+	if err != nil {
+		t.Fatalf("Key directory missing: %v", err)
+	}
+	if dirInfo.Mode().Perm() != 0700 {
+		t.Errorf("Expected key directory mode 0700, got %v", dirInfo.Mode().Perm())
+	}
+
+	cleanup()
+	if _, err := os.Stat(filepath.Dir(identity.file)); !os.IsNotExist(err) {
+		t.Errorf("Expected the key directory to be removed, got %v", err)
+	}
+}
+
+func TestStageBuiltinAgent(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	privateKey, publicKey, err := GenerateKeyPair(KeyTypeECDSAP256)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair returned an error: %v", err)
+	}
+
+	identity, cleanup, err := stageSessionKey(privateKey, true)
+	if err != nil {
+		t.Fatalf("stageSessionKey returned an error: %v", err)
+	}
+	if identity.agent == "" || identity.file != "" {
+		t.Fatalf("Expected an agent socket and no key file, got %+v", identity)
+	}
+	keys := listAgentKeys(t, identity.agent)
+	if len(keys) != 1 || keys[0].String() != publicKey+" pv-mounter session key" {
+		t.Errorf("Expected the session key in the agent, got %v", keys)
+	}
+
+	cleanup()
+	if _, err := os.Stat(filepath.Dir(identity.agent)); !os.IsNotExist(err) {
+		t.Errorf("Expected the agent directory to be removed, got %v", err)
+	}
+}
+
+func TestStageRunningAgent(t *testing.T) {
+	// Stand in for the user's agent with a built-in one
+	otherKey, _, err := GenerateKeyPair(KeyTypeEd25519)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair returned an error: %v", err)
+	}
+	running, stopRunning, err := stageBuiltinAgent(otherKey)
+	if err != nil {
+		t.Fatalf("stageBuiltinAgent returned an error: %v", err)
+	}
+	defer stopRunning()
+	t.Setenv("SSH_AUTH_SOCK", running.agent)
+
+	privateKey, publicKey, err := GenerateKeyPair(KeyTypeEd25519)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair returned an error: %v", err)
+	}
+	identity, cleanup, err := stageSessionKey(privateKey, true)
+	if err != nil {
+		t.Fatalf("stageSessionKey returned an error: %v", err)
+	}
+	if identity.agent != running.agent {
+		t.Errorf("Expected the running agent %s, got %s", running.agent, identity.agent)
+	}
+	if keys := listAgentKeys(t, running.agent); len(keys) != 2 {
+		t.Errorf("Expected the session key next to the existing one, got %v", keys)
+	}
+	pinned, err := os.ReadFile(identity.publicKey)
+	if err != nil {
+		t.Fatalf("Expected the session public key in a file: %v", err)
+	}
+	if strings.TrimSpace(string(pinned)) != strings.TrimSpace(publicKey) {
+		t.Errorf("Expected the session public key %q, got %q", publicKey, pinned)
+	}
+	options := strings.Join(identity.options(), " ")
+	if !strings.Contains(options, "IdentitiesOnly=yes") || !strings.Contains(options, "IdentityFile="+identity.publicKey) {
+		t.Errorf("Expected ssh to be pinned to the session key, got %s", options)
+	}
+
+	cleanup()
+	if _, err := os.Stat(identity.publicKey); !os.IsNotExist(err) {
+		t.Errorf("Expected the public key file to be removed, got %v", err)
+	}
+	if keys := listAgentKeys(t, running.agent); len(keys) != 1 {
+		t.Errorf("Expected only the existing key after cleanup, got %v", keys)
+	}
+}
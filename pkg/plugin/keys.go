@@ -0,0 +1,116 @@
+package plugin
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyType is the algorithm of the SSH keys generated for a mount.
+type KeyType string
+
+const (
+	KeyTypeEd25519   KeyType = "ed25519"
+	KeyTypeECDSAP256 KeyType = "ecdsa-p256"
+	KeyTypeECDSAP384 KeyType = "ecdsa-p384"
+	KeyTypeRSA3072   KeyType = "rsa-3072"
+
+	DefaultKeyType = KeyTypeEd25519
+)
+
+// KeyTypes lists the supported key types, default first.
+func KeyTypes() []KeyType {
+	return []KeyType{KeyTypeEd25519, KeyTypeECDSAP256, KeyTypeECDSAP384, KeyTypeRSA3072}
+}
+
+// ParseKeyType validates a key type given on the command line. An empty
+// value selects the default.
+func ParseKeyType(value string) (KeyType, error) {
+	if value == "" {
+		return DefaultKeyType, nil
+	}
+	for _, keyType := range KeyTypes() {
+		if KeyType(strings.ToLower(value)) == keyType {
+			return keyType, nil
+		}
+	}
+	names := make([]string, 0, len(KeyTypes()))
+	for _, keyType := range KeyTypes() {
+		names = append(names, string(keyType))
+	}
+	return "", fmt.Errorf("unsupported key type %s, use one of: %s", value, strings.Join(names, ", "))
+}
+
+// GenerateKeyPair returns a new private key in the PEM format OpenSSH
+// expects for the type (OpenSSH for ed25519, SEC 1 for ECDSA, PKCS #1 for
+// RSA) and the public key in authorized_keys format.
+func GenerateKeyPair(keyType KeyType) (string, string, error) {
+	var (
+		privateKey crypto.PrivateKey
+		publicKey  crypto.PublicKey
+		block      *pem.Block
+	)
+
+	switch keyType {
+	case KeyTypeEd25519:
+		pub, priv, err := ed25519.GenerateKey(crand.Reader)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to generate private key: %v", err)
+		}
+		privateKey, publicKey = priv, pub
+
+	case KeyTypeECDSAP256, KeyTypeECDSAP384:
+		curve := elliptic.P256()
+		if keyType == KeyTypeECDSAP384 {
+			curve = elliptic.P384()
+		}
+		priv, err := ecdsa.GenerateKey(curve, crand.Reader)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to generate private key: %v", err)
+		}
+		der, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to marshal private key: %v", err)
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+		privateKey, publicKey = priv, &priv.PublicKey
+
+	case KeyTypeRSA3072:
+		priv, err := rsa.GenerateKey(crand.Reader, 3072)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to generate private key: %v", err)
+		}
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}
+		privateKey, publicKey = priv, &priv.PublicKey
+
+	default:
+		return "", "", fmt.Errorf("unsupported key type %s", keyType)
+	}
+
+	// There's no traditional PEM format for ed25519 keys that OpenSSH reads
+	if block == nil {
+		var err error
+		block, err = ssh.MarshalPrivateKey(privateKey, "")
+		if err != nil {
+			return "", "", fmt.Errorf("failed to marshal private key: %v", err)
+		}
+	}
+
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create SSH public key: %v", err)
+	}
+
+	// Encode the SSH public key to the authorized_keys format
+	publicKeyBytes := ssh.MarshalAuthorizedKey(sshPublicKey)
+	return string(pem.EncodeToMemory(block)), strings.TrimSpace(string(publicKeyBytes)), nil
+}
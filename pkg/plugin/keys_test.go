@@ -0,0 +1,95 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/pem"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGenerateKeyPair(t *testing.T) {
+	tests := []struct {
+		keyType     KeyType
+		pemType     string
+		sshKeyType  string
+		wantBitSize int
+	}{
+		{keyType: KeyTypeEd25519, pemType: "OPENSSH PRIVATE KEY", sshKeyType: ssh.KeyAlgoED25519},
+		{keyType: KeyTypeECDSAP256, pemType: "EC PRIVATE KEY", sshKeyType: ssh.KeyAlgoECDSA256},
+		{keyType: KeyTypeECDSAP384, pemType: "EC PRIVATE KEY", sshKeyType: ssh.KeyAlgoECDSA384},
+		{keyType: KeyTypeRSA3072, pemType: "RSA PRIVATE KEY", sshKeyType: ssh.KeyAlgoRSA, wantBitSize: 3072},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.keyType), func(t *testing.T) {
+			privateKey, publicKey, err := GenerateKeyPair(tt.keyType)
+			if err != nil {
+				t.Fatalf("GenerateKeyPair returned an error: %v", err)
+			}
+
+			block, _ := pem.Decode([]byte(privateKey))
+			if block == nil || block.Type != tt.pemType {
+				t.Fatalf("Expected a %s PEM block, got %q", tt.pemType, privateKey)
+			}
+
+			signer, err := ssh.ParsePrivateKey([]byte(privateKey))
+			if err != nil {
+				t.Fatalf("Failed to parse private key: %v", err)
+			}
+			parsedPublicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+			if err != nil {
+				t.Fatalf("Failed to parse public key: %v", err)
+			}
+			if parsedPublicKey.Type() != tt.sshKeyType {
+				t.Errorf("Expected key type %s, got %s", tt.sshKeyType, parsedPublicKey.Type())
+			}
+			if !bytes.Equal(signer.PublicKey().Marshal(), parsedPublicKey.Marshal()) {
+				t.Error("Public key doesn't match the private key")
+			}
+
+			// A signature made with the private key verifies with the public one
+			data := []byte("pv-mounter")
+			signature, err := signer.Sign(nil, data)
+			if err != nil {
+				t.Fatalf("Failed to sign: %v", err)
+			}
+			if err := parsedPublicKey.Verify(data, signature); err != nil {
+				t.Errorf("Signature didn't verify: %v", err)
+			}
+
+			if tt.wantBitSize != 0 {
+				cryptoKey := parsedPublicKey.(ssh.CryptoPublicKey).CryptoPublicKey()
+				if size := cryptoKey.(interface{ Size() int }).Size() * 8; size != tt.wantBitSize {
+					t.Errorf("Expected a %d-bit key, got %d", tt.wantBitSize, size)
+				}
+			}
+		})
+	}
+}
+
+func TestParseKeyType(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    KeyType
+		wantErr bool
+	}{
+		{value: "", want: KeyTypeEd25519},
+		{value: "ed25519", want: KeyTypeEd25519},
+		{value: "ECDSA-P384", want: KeyTypeECDSAP384},
+		{value: "rsa-3072", want: KeyTypeRSA3072},
+		{value: "rsa-1024", wantErr: true},
+		{value: "dsa", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseKeyType(tt.value)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseKeyType(%q) should have returned an error", tt.value)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("ParseKeyType(%q) = %s, %v; want %s", tt.value, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// leaseDuration is how long a session survives without a heartbeat
+	// before gc may remove it.
+	leaseDuration = 5 * time.Minute
+	// leaseRenewInterval leaves room for a few failed renewals.
+	leaseRenewInterval = time.Minute
+)
+
+// sessionLeaseName is the name of the Lease that keeps a session alive.
+func sessionLeaseName(mountID string) string {
+	return fmt.Sprintf("volume-exposer-%s", mountID)
+}
+
+// createSessionLease creates the heartbeat Lease of the session, held by this
+// machine. Without access to Leases the session goes without one, and an
+// empty name is returned.
+func createSessionLease(ctx context.Context, clientset kubernetes.Interface, state *MountState) (string, error) {
+	hostName, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine hostname: %v", err)
+	}
+	holder := fmt.Sprintf("pv-mounter@%s", hostName)
+	durationSeconds := int32(leaseDuration.Seconds())
+	now := metav1.NewMicroTime(time.Now())
+
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: sessionLeaseName(state.ID),
+			Labels: map[string]string{
+				"app":        "volume-exposer",
+				"pvcName":    state.PVCName,
+				MountIDLabel: state.ID,
+			},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &durationSeconds,
+			AcquireTime:          &now,
+			RenewTime:            &now,
+		},
+	}
+
+	_, err = clientset.CoordinationV1().Leases(state.Namespace).Create(ctx, lease, metav1.CreateOptions{})
+	if apierrors.IsForbidden(err) {
+		fmt.Printf("Warning: not allowed to create a Lease (%v), gc won't notice if this session is abandoned\n", err)
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create lease: %v", err)
+	}
+	fmt.Printf("Lease %s created successfully\n", lease.Name)
+	return lease.Name, nil
+}
+
+// renewSessionLease moves the renew time of the session Lease to now.
+func renewSessionLease(ctx context.Context, clientset kubernetes.Interface, namespace, mountID string) error {
+	leases := clientset.CoordinationV1().Leases(namespace)
+	lease, err := leases.Get(ctx, sessionLeaseName(mountID), metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get lease: %v", err)
+	}
+	now := metav1.NewMicroTime(time.Now())
+	lease.Spec.RenewTime = &now
+	if _, err := leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to renew lease: %v", err)
+	}
+	return nil
+}
+
+// keepLeaseAlive renews the session Lease until ctx is done. Failed renewals
+// are only reported, the next one may well succeed.
+func keepLeaseAlive(ctx context.Context, clientset kubernetes.Interface, namespace, mountID string) {
+	ticker := time.NewTicker(leaseRenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := renewSessionLease(ctx, clientset, namespace, mountID); err != nil && ctx.Err() == nil {
+				fmt.Printf("Warning: %v\n", err)
+			}
+		}
+	}
+}
+
+// renewLeaseInBackground runs keepLeaseAlive until the returned function is
+// called.
+func renewLeaseInBackground(ctx context.Context, clientset kubernetes.Interface, namespace, mountID string) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		keepLeaseAlive(ctx, clientset, namespace, mountID)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// leaseExpired reports whether the holder stopped renewing the Lease.
+func leaseExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	expiry := lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second)
+	return now.After(expiry)
+}
+
+func deleteSessionLease(ctx context.Context, clientset kubernetes.Interface, namespace, mountID string, out io.Writer) error {
+	if mountID == "" {
+		return nil
+	}
+	leaseName := sessionLeaseName(mountID)
+	err := clientset.CoordinationV1().Leases(namespace).Delete(ctx, leaseName, metav1.DeleteOptions{})
+	// Without access to Leases the session never got one
+	if apierrors.IsNotFound(err) || apierrors.IsForbidden(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete lease: %v", err)
+	}
+	fmt.Fprintf(out, "Lease %s deleted successfully\n", leaseName)
+	return nil
+}
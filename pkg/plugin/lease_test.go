@@ -0,0 +1,104 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestSessionLeaseLifecycle(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	state := &MountState{ID: "abcdefgh", Namespace: "default", PVCName: "data"}
+
+	leaseName, err := createSessionLease(ctx, clientset, state)
+	if err != nil {
+		t.Fatalf("createSessionLease() returned error: %v", err)
+	}
+	lease, err := clientset.CoordinationV1().Leases("default").Get(ctx, leaseName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get lease: %v", err)
+	}
+	if lease.Labels[MountIDLabel] != "abcdefgh" {
+		t.Errorf("Expected the lease to carry the mount ID, got %v", lease.Labels)
+	}
+	if leaseExpired(lease, time.Now()) {
+		t.Error("Expected a fresh lease not to be expired")
+	}
+	created := lease.Spec.RenewTime.Time
+
+	time.Sleep(10 * time.Millisecond)
+	if err := renewSessionLease(ctx, clientset, "default", state.ID); err != nil {
+		t.Fatalf("renewSessionLease() returned error: %v", err)
+	}
+	lease, err = clientset.CoordinationV1().Leases("default").Get(ctx, leaseName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get lease: %v", err)
+	}
+	if !lease.Spec.RenewTime.After(created) {
+		t.Errorf("Expected the renew time to move past %v, got %v", created, lease.Spec.RenewTime)
+	}
+
+	if err := deleteSessionLease(ctx, clientset, "default", state.ID, io.Discard); err != nil {
+		t.Fatalf("deleteSessionLease() returned error: %v", err)
+	}
+	// A second delete finds nothing and still succeeds
+	if err := deleteSessionLease(ctx, clientset, "default", state.ID, io.Discard); err != nil {
+		t.Errorf("deleteSessionLease() of a missing lease returned error: %v", err)
+	}
+}
+
+func TestSessionLeaseForbidden(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	clientset.PrependReactor("*", "leases", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(coordinationv1.Resource("leases"), "", errors.New("RBAC says no"))
+	})
+	state := &MountState{ID: "abcdefgh", Namespace: "default", PVCName: "data"}
+
+	leaseName, err := createSessionLease(ctx, clientset, state)
+	if err != nil {
+		t.Fatalf("createSessionLease() returned error: %v", err)
+	}
+	if leaseName != "" {
+		t.Errorf("Expected no lease without access to leases, got %s", leaseName)
+	}
+	if err := deleteSessionLease(ctx, clientset, "default", state.ID, io.Discard); err != nil {
+		t.Errorf("deleteSessionLease() without access to leases returned error: %v", err)
+	}
+}
+
+func TestLeaseExpired(t *testing.T) {
+	now := time.Now()
+	duration := int32(300)
+	renewed := func(ago time.Duration) *coordinationv1.Lease {
+		renewTime := metav1.NewMicroTime(now.Add(-ago))
+		return &coordinationv1.Lease{Spec: coordinationv1.LeaseSpec{RenewTime: &renewTime, LeaseDurationSeconds: &duration}}
+	}
+
+	tests := []struct {
+		name  string
+		lease *coordinationv1.Lease
+		want  bool
+	}{
+		{"recently renewed", renewed(time.Minute), false},
+		{"not renewed for longer than its duration", renewed(6 * time.Minute), true},
+		{"never renewed", &coordinationv1.Lease{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := leaseExpired(tt.lease, now); got != tt.want {
+				t.Errorf("leaseExpired() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,25 +2,26 @@ package plugin
 
 import (
 	"context"
-	"crypto/elliptic"
 	"encoding/json"
 	"fmt"
-	"math/rand"
 	"os"
 	"os/exec"
+	"path"
+	"strings"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
-	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 const (
-	ImageVersion = "v0.2.3"
-	//"v0.2.1"
+	ImageVersion = "v0.7.0"
+	//"v0.6.0"
 	Image                  = "bfenski/volume-exposer:" + ImageVersion
 	PrivilegedImage        = "bfenski/volume-exposer-privileged:" + ImageVersion
 	DefaultUserGroup int64 = 2137
@@ -32,9 +33,63 @@ const (
 	MemoryLimit             = "100Mi"
 	EphemeralStorageRequest = "1Mi"
 	EphemeralStorageLimit   = "2Mi"
+
+	// Every pod created by a mount carries the session ID, and the annotations
+	// tie it to the machine and directory it is mounted on.
+	MountIDLabel                 = "mountID"
+	MountPointAnnotation         = "mountPoint"
+	HostNameAnnotation           = "hostName"
+	EphemeralContainerAnnotation = "ephemeralContainer"
 )
 
-func Mount(ctx context.Context, namespace, pvcName, localMountPoint string, needsRoot, debug bool) error {
+// MountOptions tunes how Mount exposes the volume.
+type MountOptions struct {
+	// NeedsRoot runs the exposer as root.
+	NeedsRoot bool
+	// Debug prints additional information, including the private key.
+	Debug bool
+	// ReadOnly blocks writes in the pod spec, the container and sshfs.
+	ReadOnly bool
+	// SubPath mounts only this directory of the volume.
+	SubPath string
+	// InheritIdentity runs the ephemeral container with the UID, GID and
+	// SELinux context of the container that mounts the volume.
+	InheritIdentity bool
+	// AsOwner runs the standalone exposer as the owner of the volume root.
+	AsOwner bool
+	// KeyType is the algorithm of the client and host keys.
+	KeyType KeyType
+	// SSHAgent hands the private key to sshfs through ssh-agent instead of a
+	// temporary file.
+	SSHAgent bool
+	// KeepOnFailure leaves everything created so far in place when the mount
+	// fails, for debugging.
+	KeepOnFailure bool
+	// MaxLifetime bounds how long the pods and the ephemeral container may
+	// run, even if the mount is still in use. Zero means no limit.
+	MaxLifetime time.Duration
+	// Volume names the volume to mount when the target is a pod, as in
+	// pod/web-0. It may be of any type, not only a PVC.
+	Volume string
+	// Ordinal picks the pod of a StatefulSet target, as in sts/postgres.
+	// It may be left out when there's only one replica.
+	Ordinal *int
+	// TargetPod names the pod to treat as the one using a ReadWriteOnce or
+	// ReadWriteOncePod volume when several reference it.
+	TargetPod string
+	// Timeout bounds how long the pods, the --as-owner inspection pod
+	// included, and the ephemeral container may take to start. Zero means
+	// DefaultStartTimeout.
+	Timeout time.Duration
+	// Foreground keeps Mount running, with the port-forward in-process and
+	// sshfs attached, until ctx is cancelled; then it cleans up by itself.
+	Foreground bool
+}
+
+// Mount exposes the PVC over SSH and mounts it at localMountPoint. When any
+// step fails, or ctx is cancelled by a signal, everything created so far is
+// rolled back unless opts.KeepOnFailure is set.
+func Mount(ctx context.Context, configFlags *genericclioptions.ConfigFlags, namespace, pvcName, localMountPoint string, opts MountOptions) error {
 
 	checkSSHFS()
 
@@ -42,27 +97,143 @@ func Mount(ctx context.Context, namespace, pvcName, localMountPoint string, need
 		return err
 	}
 
-	clientset, err := BuildKubeClient()
+	subPath, err := cleanSubPath(opts.SubPath)
 	if err != nil {
 		return err
 	}
+	opts.SubPath = subPath
+
+	if opts.KeyType == "" {
+		opts.KeyType = DefaultKeyType
+	}
+
+	switch {
+	case opts.MaxLifetime < 0:
+		return fmt.Errorf("max lifetime can't be negative, got %s", opts.MaxLifetime)
+	case opts.MaxLifetime > 0 && opts.MaxLifetime < time.Second:
+		return fmt.Errorf("max lifetime must be at least a second, got %s", opts.MaxLifetime)
+	case opts.MaxLifetime > 0:
+		fmt.Printf("Warning: the pods and the ephemeral container stop after %s, the mount stops working then; the stopped pods and their Secret stay until clean or gc\n", opts.MaxLifetime)
+	}
 
-	pvc, err := checkPVCUsage(ctx, clientset, namespace, pvcName)
+	if opts.Timeout < 0 {
+		return fmt.Errorf("timeout can't be negative, got %s", opts.Timeout)
+	}
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultStartTimeout
+	}
+
+	mountPoint, err := absMountPoint(localMountPoint)
 	if err != nil {
 		return err
 	}
 
-	canBeMounted, podUsingPVC, err := checkPVAccessMode(ctx, clientset, pvc, namespace)
+	if mounted, err := isMounted(mountPoint); err == nil && mounted {
+		return fmt.Errorf("%s is already mounted, run clean first", mountPoint)
+	}
+
+	clientset, restConfig, err := BuildKubeClient(configFlags)
 	if err != nil {
 		return err
 	}
 
-	if canBeMounted {
-		return handleRWX(ctx, clientset, namespace, pvcName, localMountPoint, needsRoot, debug)
+	kubeContext, err := currentContext(configFlags)
+	if err != nil {
+		return err
+	}
+
+	pvcName, err = resolveWorkload(ctx, clientset, namespace, pvcName, &opts)
+	if err != nil {
+		return err
+	}
+
+	var plan accessPlan
+	var volumeName, resolvedPod string
+	if podName, ok := strings.CutPrefix(pvcName, PodPrefix); ok {
+		pod, volume, err := resolvePodVolume(ctx, clientset, namespace, podName, opts.Volume)
+		if err != nil {
+			return err
+		}
+		volumeName = volume.Name
+		pvcName = volumeClaimName(pod, volume)
+		if pvcName == "" {
+			plan, err = planPodVolume(pod, volume)
+			if err != nil {
+				return err
+			}
+		} else {
+			// The claim decides how to get at it, through this very pod if need be
+			fmt.Printf("Volume %s of pod %s is PVC %s\n", volume.Name, podName, pvcName)
+			resolvedPod = podName
+		}
+	} else if opts.Volume != "" {
+		return fmt.Errorf("--volume only applies to %s<name> targets", PodPrefix)
+	}
+
+	if pvcName != "" {
+		pvc, err := checkPVCUsage(ctx, clientset, namespace, pvcName)
+		if err != nil {
+			return err
+		}
+
+		plan, err = checkPVAccessMode(ctx, clientset, pvc, namespace, opts.TargetPod, resolvedPod)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Println(plan.reason)
+	opts.ReadOnly = opts.ReadOnly || plan.readOnly
+
+	state := &MountState{
+		ID:         randSeq(8),
+		Context:    kubeContext,
+		Namespace:  namespace,
+		PVCName:    pvcName,
+		Volume:     volumeName,
+		SubPath:    opts.SubPath,
+		MountPoint: mountPoint,
+		CreatedAt:  time.Now(),
 	}
 
-	return handleRWO(ctx, clientset, namespace, pvcName, localMountPoint, podUsingPVC, needsRoot, debug)
+	rb := &rollback{}
+	exited, err := setupSession(ctx, configFlags, clientset, restConfig, state, rb, plan, opts)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("mount interrupted: %v", err)
+		}
+		if opts.KeepOnFailure {
+			if saveErr := saveMountState(state); saveErr != nil {
+				fmt.Printf("Warning: failed to record the failed mount: %v\n", saveErr)
+			}
+			fmt.Printf("Keeping everything created so far, run clean on %s to remove it\n", mountPoint)
+		} else {
+			fmt.Println("Mount failed, rolling back")
+			rb.unwind(ctx)
+		}
+		return err
+	}
 
+	if !opts.Foreground {
+		state.SSHFSPID = findSSHFSPID(mountPoint)
+	}
+	if err := saveMountState(state); err != nil {
+		fmt.Printf("Warning: mount succeeded but could not be recorded: %v\n", err)
+	}
+	if !opts.Foreground {
+		return nil
+	}
+
+	// Stay attached until interrupted, then tear everything down the same
+	// way a failed mount is rolled back
+	fmt.Printf("Press Ctrl-C to unmount %s and clean up\n", mountPoint)
+	select {
+	case <-ctx.Done():
+	case <-exited:
+		fmt.Println("sshfs exited")
+	}
+	fmt.Println("Unmounting and cleaning up")
+	rb.unwind(ctx)
+	return nil
 }
 
 func validateMountPoint(localMountPoint string) error {
@@ -72,124 +243,307 @@ func validateMountPoint(localMountPoint string) error {
 	return nil
 }
 
-func handleRWX(ctx context.Context, clientset *kubernetes.Clientset, namespace, pvcName, localMountPoint string, needsRoot bool, debug bool) error {
+// cleanSubPath normalizes a sub-path of the volume and makes sure it can't
+// point outside of it.
+func cleanSubPath(subPath string) (string, error) {
+	if subPath == "" {
+		return "", nil
+	}
+	if path.IsAbs(subPath) {
+		return "", fmt.Errorf("sub-path %s must be relative to the volume root", subPath)
+	}
+	cleaned := path.Clean(subPath)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fmt.Errorf("sub-path %s points outside of the volume", subPath)
+	}
+	if cleaned == "." {
+		return "", nil
+	}
+	return cleaned, nil
+}
+
+// remoteVolumePath is the directory sshfs mounts inside the exposer.
+func remoteVolumePath(subPath string) string {
+	return path.Join("/volume", subPath)
+}
 
-	privateKey, publicKey, err := GenerateKeyPair(elliptic.P256())
+// setupSession creates everything the mount needs, records how to undo each
+// step in rb and finally mounts the volume. In foreground mode the returned
+// channel is closed when sshfs exits.
+func setupSession(ctx context.Context, configFlags *genericclioptions.ConfigFlags, clientset *kubernetes.Clientset, restConfig *rest.Config, state *MountState, rb *rollback, plan accessPlan, opts MountOptions) (<-chan struct{}, error) {
+	keys, err := generateSessionKeys(opts.KeyType)
 	if err != nil {
-		return fmt.Errorf("error generating key pair: %v", err)
+		return nil, err
 	}
 
-	if debug {
-		fmt.Printf("Private Key:\n%s\n", privateKey)
+	if opts.Debug {
+		fmt.Printf("Private Key:\n%s\n", keys.privateKey)
 	}
 
-	podName, port, err := setupPod(ctx, clientset, namespace, pvcName, publicKey, "standalone", DefaultSSHPort, "", needsRoot)
+	knownHostsFile, err := writeKnownHosts(state.ID, hostKeyAlias(state.ID), keys.hostPublicKey)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	rb.add("remove local session files", func(ctx context.Context) error {
+		return removeMountState(state.ID)
+	})
+
+	// Only the ephemeral container logs in anywhere, so only it needs the client key
+	secretName, err := createSessionSecret(ctx, clientset, state, keys, plan.strategy == strategyEphemeral)
+	if err != nil {
+		return nil, err
 	}
+	rb.add(fmt.Sprintf("delete secret %s", secretName), func(ctx context.Context) error {
+		return deleteSessionSecret(ctx, clientset, state.Namespace, state.ID, os.Stdout)
+	})
 
-	if err := waitForPodReady(ctx, clientset, namespace, podName); err != nil {
-		return err
+	leaseName, err := createSessionLease(ctx, clientset, state)
+	if err != nil {
+		return nil, err
+	}
+	if leaseName != "" {
+		rb.add(fmt.Sprintf("delete lease %s", leaseName), func(ctx context.Context) error {
+			return deleteSessionLease(ctx, clientset, state.Namespace, state.ID, os.Stdout)
+		})
+		// Keep the lease alive while setting up; afterwards the port-forward
+		// renews it for as long as the mount lives
+		stopRenewing := renewLeaseInBackground(ctx, clientset, state.Namespace, state.ID)
+		if opts.Foreground {
+			rb.add("stop renewing lease", func(ctx context.Context) error {
+				stopRenewing()
+				return nil
+			})
+		} else {
+			defer stopRenewing()
+		}
 	}
 
-	if err := setupPortForwarding(namespace, podName, port); err != nil {
-		return err
+	switch plan.strategy {
+	case strategyStandalone:
+		if opts.InheritIdentity {
+			fmt.Println("Warning: --inherit-identity only applies to ephemeral containers, ignoring it")
+		}
+		err = handleRWX(ctx, clientset, state, rb, secretName, plan.nodeName, opts)
+	case strategyEphemeral:
+		if opts.AsOwner {
+			fmt.Println("Warning: --as-owner only applies to standalone pods, use --inherit-identity instead")
+		}
+		err = handleRWO(ctx, clientset, restConfig, state, rb, keys, secretName, plan.podUsingPVC, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Foreground {
+		stop, err := forwardInForeground(ctx, restConfig, clientset, state)
+		if err != nil {
+			return nil, err
+		}
+		rb.add("stop port-forward", func(ctx context.Context) error {
+			stop()
+			return nil
+		})
+		if err := waitForSession(ctx, restConfig, clientset, state); err != nil {
+			return nil, err
+		}
+
+		exited, stopSSHFS, err := mountPVCOverSSHForeground(ctx, state, keys.privateKey, knownHostsFile, opts)
+		if err != nil {
+			return nil, err
+		}
+		rb.add(fmt.Sprintf("unmount %s", state.MountPoint), func(ctx context.Context) error {
+			return stopSSHFS()
+		})
+		return exited, nil
+	}
+
+	if err := setupPortForwarding(ctx, configFlags, state, leaseName != ""); err != nil {
+		return nil, err
+	}
+	rb.add("stop port-forward", func(ctx context.Context) error {
+		return stopPortForwarder(state)
+	})
+	if err := waitForSession(ctx, restConfig, clientset, state); err != nil {
+		return nil, err
 	}
 
-	return mountPVCOverSSH(port, localMountPoint, pvcName, privateKey, needsRoot)
+	return nil, mountPVCOverSSH(ctx, state.LocalPort, state.MountPoint, state.source(), keys.privateKey, knownHostsFile, hostKeyAlias(state.ID), opts.SubPath, opts.SSHAgent, opts.NeedsRoot, opts.ReadOnly)
 }
 
-func handleRWO(ctx context.Context, clientset *kubernetes.Clientset, namespace, pvcName, localMountPoint string, podUsingPVC string, needsRoot bool, debug bool) error {
+func handleRWX(ctx context.Context, clientset *kubernetes.Clientset, state *MountState, rb *rollback, secretName, nodeName string, opts MountOptions) error {
 
-	privateKey, publicKey, err := GenerateKeyPair(elliptic.P256())
-	if err != nil {
-		return fmt.Errorf("error generating key pair: %v", err)
+	var owner *volumeOwner
+	var err error
+	if opts.AsOwner && opts.NeedsRoot {
+		fmt.Println("Warning: --as-owner has no effect together with --needs-root")
+	} else if opts.AsOwner {
+		owner, err = detectVolumeOwner(ctx, clientset, state.Namespace, state.PVCName, nodeName, opts.SubPath, opts.Timeout)
+		if err != nil {
+			return err
+		}
 	}
 
-	if debug {
-		fmt.Printf("Private Key:\n%s\n", privateKey)
+	podName, err := setupPod(ctx, clientset, state, secretName, "standalone", DefaultSSHPort, "", nodeName, opts.SubPath, owner, opts.MaxLifetime, opts.NeedsRoot, opts.ReadOnly)
+	if err != nil {
+		return err
 	}
+	state.PodName = podName
+	rb.add(fmt.Sprintf("delete pod %s", podName), func(ctx context.Context) error {
+		return deletePod(ctx, clientset, state.Namespace, podName, os.Stdout)
+	})
 
-	podName, port, err := setupPod(ctx, clientset, namespace, pvcName, publicKey, "proxy", ProxySSHPort, podUsingPVC, needsRoot)
+	return waitForPodReady(ctx, clientset, state.Namespace, podName, opts.Timeout)
+}
+
+func handleRWO(ctx context.Context, clientset *kubernetes.Clientset, restConfig *rest.Config, state *MountState, rb *rollback, keys *sessionKeys, secretName, podUsingPVC string, opts MountOptions) error {
+
+	podName, err := setupPod(ctx, clientset, state, secretName, "proxy", ProxySSHPort, podUsingPVC, "", "", nil, opts.MaxLifetime, opts.NeedsRoot, false)
 	if err != nil {
 		return err
 	}
+	state.PodName = podName
+	rb.add(fmt.Sprintf("delete pod %s", podName), func(ctx context.Context) error {
+		return deletePod(ctx, clientset, state.Namespace, podName, os.Stdout)
+	})
 
-	if err := waitForPodReady(ctx, clientset, namespace, podName); err != nil {
+	if err := waitForPodReady(ctx, clientset, state.Namespace, podName, opts.Timeout); err != nil {
 		return err
 	}
 
-	proxyPodIP, err := getPodIP(ctx, clientset, namespace, podName)
+	proxyPodIP, err := getPodIP(ctx, clientset, state.Namespace, podName)
 	if err != nil {
 		return err
 	}
 
-	if err := createEphemeralContainer(ctx, clientset, namespace, podUsingPVC, privateKey, publicKey, proxyPodIP, needsRoot); err != nil {
+	ephemeralContainerName, err := createEphemeralContainer(ctx, clientset, restConfig, state.Namespace, podUsingPVC, state.PVCName, state.Volume, secretName, proxyPodIP, keys, opts)
+	if ephemeralContainerName != "" {
+		// Also when it never came up: it can't be removed, but its tunnel can
+		state.TargetPodName = podUsingPVC
+		state.EphemeralContainer = ephemeralContainerName
+		rb.add(fmt.Sprintf("detach ephemeral container %s", ephemeralContainerName), func(ctx context.Context) error {
+			return detachEphemeralContainer(ctx, restConfig, clientset, state.Namespace, podUsingPVC, ephemeralContainerName, os.Stdout)
+		})
+	}
+	if err != nil {
 		return err
 	}
 
-	if err := setupPortForwarding(namespace, podName, port); err != nil {
-		return err
+	if opts.SubPath != "" {
+		// Ephemeral containers can't use subPath mounts, so the whole volume is there
+		fmt.Printf("Warning: ephemeral containers can't restrict the volume to %s, the rest of it stays reachable over SFTP\n", opts.SubPath)
 	}
 
-	return mountPVCOverSSH(port, localMountPoint, pvcName, privateKey, needsRoot)
+	return annotatePod(ctx, clientset, state.Namespace, podName, EphemeralContainerAnnotation, ephemeralContainerName)
 }
 
-func createEphemeralContainer(ctx context.Context, clientset *kubernetes.Clientset, namespace, podName, privateKey, publicKey, proxyPodIP string, needsRoot bool) error {
+// createEphemeralContainer runs the tunnel in the pod that uses the volume,
+// reusing a running pv-mounter ephemeral container when there's a matching
+// one. It returns the container name as soon as there is a container, also
+// together with an error when it didn't come up.
+func createEphemeralContainer(ctx context.Context, clientset *kubernetes.Clientset, restConfig *rest.Config, namespace, podName, pvcName, podVolume, secretName, proxyPodIP string, keys *sessionKeys, opts MountOptions) (string, error) {
 	// Retrieve the existing pod to get the volume name
 	existingPod, err := clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
 	if err != nil {
-		return fmt.Errorf("failed to get existing pod: %v", err)
+		return "", fmt.Errorf("failed to get existing pod: %v", err)
 	}
 
-	volumeName, err := getPVCVolumeName(existingPod)
+	volumeName, err := podVolumeName(existingPod, pvcName, podVolume)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	var identity *containerIdentity
+	if opts.InheritIdentity {
+		identity, err = targetIdentity(existingPod, volumeName)
+		if err != nil {
+			return "", err
+		}
+		if err := checkIdentity(identity, opts.NeedsRoot); err != nil {
+			return "", err
+		}
+		fmt.Printf("Inheriting the identity of %s\n", identity.describe())
+	}
+
+	ephemeralContainerName := EphemeralContainerPrefix + randSeq(5)
+	ephemeralContainer := createEphemeralContainerSpec(ephemeralContainerName, volumeName, secretName, proxyPodIP, identity, opts.NeedsRoot, opts.ReadOnly)
+	if opts.MaxLifetime > 0 {
+		// Ephemeral containers have no deadline of their own, the entrypoint
+		// stops its keepalive instead
+		ephemeralContainer.Env = append(ephemeralContainer.Env, corev1.EnvVar{
+			Name:  "MAX_LIFETIME",
+			Value: fmt.Sprintf("%d", int64(opts.MaxLifetime.Seconds())),
+		})
+	}
+
+	claimed, err := claimedEphemeralContainers(ctx, clientset, namespace, podName)
+	if err != nil {
+		return "", err
+	}
+	if name := reusableEphemeralContainer(existingPod, ephemeralContainer, claimed); name != "" {
+		fmt.Printf("Reusing ephemeral container %s in pod %s\n", name, podName)
+		err := restartTunnel(ctx, restConfig, clientset, namespace, podName, name, keys, proxyPodIP, envValue(ephemeralContainer.Env, "MAX_LIFETIME"))
+		if err == nil {
+			return name, nil
+		}
+		fmt.Printf("Warning: %v, adding a new ephemeral container\n", err)
 	}
 
-	ephemeralContainerName := fmt.Sprintf("volume-exposer-ephemeral-%s", randSeq(5))
 	fmt.Printf("Adding ephemeral container %s to pod %s with volume name %s\n", ephemeralContainerName, podName, volumeName)
 
+	patchData, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"ephemeralContainers": []corev1.EphemeralContainer{ephemeralContainer},
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal ephemeral container spec: %v", err)
+	}
+
+	_, err = clientset.CoreV1().Pods(namespace).Patch(ctx, podName, types.StrategicMergePatchType, patchData, metav1.PatchOptions{}, "ephemeralcontainers")
+	if err != nil {
+		return "", fmt.Errorf("failed to patch pod with ephemeral container: %v", err)
+	}
+
+	fmt.Printf("Successfully added ephemeral container %s to pod %s\n", ephemeralContainerName, podName)
+	return ephemeralContainerName, waitForEphemeralContainer(ctx, clientset, namespace, podName, ephemeralContainerName, opts.Timeout)
+}
+
+// createEphemeralContainerSpec builds the ephemeral container. The keys come
+// from the session Secret. With an identity it runs as the container that
+// mounts the volume and shares its process namespace.
+func createEphemeralContainerSpec(ephemeralContainerName, volumeName, secretName, proxyPodIP string, identity *containerIdentity, needsRoot, readOnly bool) corev1.EphemeralContainer {
 	image, securityContext := getEphemeralContainerSettings(needsRoot)
 
-	ephemeralContainer := corev1.EphemeralContainer{
+	container := corev1.EphemeralContainer{
 		EphemeralContainerCommon: corev1.EphemeralContainerCommon{
 			Name:            ephemeralContainerName,
 			Image:           image,
 			ImagePullPolicy: corev1.PullAlways,
 			Env: []corev1.EnvVar{
 				{Name: "ROLE", Value: "ephemeral"},
-				{Name: "SSH_PRIVATE_KEY", Value: privateKey},
+				secretEnvVar("SSH_PRIVATE_KEY", secretName, PrivateKeySecretKey),
 				{Name: "PROXY_POD_IP", Value: proxyPodIP},
-				{Name: "SSH_PUBLIC_KEY", Value: publicKey},
+				secretEnvVar("SSH_PUBLIC_KEY", secretName, PublicKeySecretKey),
+				secretEnvVar("SSH_HOST_KEY", secretName, HostKeySecretKey),
+				secretEnvVar("SSH_HOST_PUBLIC_KEY", secretName, HostPublicKeySecretKey),
 				{Name: "NEEDS_ROOT", Value: fmt.Sprintf("%v", needsRoot)},
+				{Name: "CONTAINER_NAME", Value: ephemeralContainerName},
+				{Name: "IDLE_TIMEOUT", Value: fmt.Sprintf("%d", int64(ephemeralIdleTimeout.Seconds()))},
 			},
 			SecurityContext: securityContext,
 			VolumeMounts: []corev1.VolumeMount{
 				{
 					Name:      volumeName,
 					MountPath: "/volume",
+					ReadOnly:  readOnly,
 				},
 			},
 		},
 	}
-
-	patchData, err := json.Marshal(map[string]interface{}{
-		"spec": map[string]interface{}{
-			"ephemeralContainers": []corev1.EphemeralContainer{ephemeralContainer},
-		},
-	})
-	if err != nil {
-		return fmt.Errorf("failed to marshal ephemeral container spec: %v", err)
-	}
-
-	_, err = clientset.CoreV1().Pods(namespace).Patch(ctx, podName, types.StrategicMergePatchType, patchData, metav1.PatchOptions{}, "ephemeralcontainers")
-	if err != nil {
-		return fmt.Errorf("failed to patch pod with ephemeral container: %v", err)
+	if identity != nil {
+		identity.apply(&container)
 	}
-
-	fmt.Printf("Successfully added ephemeral container %s to pod %s\n", ephemeralContainerName, podName)
-	return nil
+	return container
 }
 
 func getPodIP(ctx context.Context, clientset kubernetes.Interface, namespace, podName string) (string, error) {
@@ -200,38 +554,6 @@ func getPodIP(ctx context.Context, clientset kubernetes.Interface, namespace, po
 	return pod.Status.PodIP, nil
 }
 
-func checkPVAccessMode(ctx context.Context, clientset *kubernetes.Clientset, pvc *corev1.PersistentVolumeClaim, namespace string) (bool, string, error) {
-	pvName := pvc.Spec.VolumeName
-	pv, err := clientset.CoreV1().PersistentVolumes().Get(ctx, pvName, metav1.GetOptions{})
-	if err != nil {
-		return true, "", fmt.Errorf("failed to get PV: %v", err)
-	}
-
-	if contains(pv.Spec.AccessModes, corev1.ReadWriteOnce) {
-		podList, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
-		if err != nil {
-			return true, "", fmt.Errorf("failed to list pods: %v", err)
-		}
-		for _, pod := range podList.Items {
-			for _, volume := range pod.Spec.Volumes {
-				if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == pvc.Name {
-					return false, pod.Name, nil
-				}
-			}
-		}
-	}
-	return true, "", nil
-}
-
-func contains(modes []corev1.PersistentVolumeAccessMode, modeToFind corev1.PersistentVolumeAccessMode) bool {
-	for _, mode := range modes {
-		if mode == modeToFind {
-			return true
-		}
-	}
-	return false
-}
-
 func checkPVCUsage(ctx context.Context, clientset *kubernetes.Clientset, namespace, pvcName string) (*corev1.PersistentVolumeClaim, error) {
 	pvc, err := clientset.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, pvcName, metav1.GetOptions{})
 	if err != nil {
@@ -243,104 +565,158 @@ func checkPVCUsage(ctx context.Context, clientset *kubernetes.Clientset, namespa
 	return pvc, nil
 }
 
-func setupPod(ctx context.Context, clientset *kubernetes.Clientset, namespace, pvcName, publicKey, role string, sshPort int, originalPodName string, needsRoot bool) (string, int, error) {
-	podName, port := generatePodNameAndPort(role)
-	pod := createPodSpec(podName, port, pvcName, publicKey, role, sshPort, originalPodName, needsRoot)
-	if _, err := clientset.CoreV1().Pods(namespace).Create(ctx, pod, metav1.CreateOptions{}); err != nil {
-		return "", 0, fmt.Errorf("failed to create pod: %v", err)
+func setupPod(ctx context.Context, clientset *kubernetes.Clientset, state *MountState, secretName, role string, sshPort int, originalPodName, nodeName, subPath string, owner *volumeOwner, maxLifetime time.Duration, needsRoot, readOnly bool) (string, error) {
+	podName := generatePodName(role)
+	pod := createPodSpec(podName, state.PVCName, secretName, role, sshPort, originalPodName, nodeName, subPath, needsRoot, readOnly)
+	if owner != nil {
+		owner.apply(pod)
+	}
+	if maxLifetime > 0 {
+		// The kubelet stops the pod once this runs out, whatever happens locally
+		deadline := int64(maxLifetime.Seconds())
+		pod.Spec.ActiveDeadlineSeconds = &deadline
+	}
+	if err := tagSession(pod, state); err != nil {
+		return "", err
+	}
+	created, err := clientset.CoreV1().Pods(state.Namespace).Create(ctx, pod, metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to create pod: %v", admissionFailure(err, state.Namespace, needsRoot))
 	}
 	fmt.Printf("Pod %s created successfully\n", podName)
-	return podName, port, nil
+	if err := setSecretOwner(ctx, clientset, state.Namespace, secretName, created); err != nil {
+		fmt.Printf("Warning: %v, it will only be removed by clean\n", err)
+	}
+	return podName, nil
 }
 
-func waitForPodReady(ctx context.Context, clientset *kubernetes.Clientset, namespace, podName string) error {
-	return wait.PollUntilContextTimeout(ctx, time.Second, 5*time.Minute, true, func(ctx context.Context) (bool, error) {
-		pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
-		if err != nil {
-			return false, err
-		}
-		for _, cond := range pod.Status.Conditions {
-			if cond.Type == corev1.PodReady && cond.Status == corev1.ConditionTrue {
-				return true, nil
-			}
-		}
-		return false, nil
+// tagSession labels the pod with the mount session ID and records where the
+// session is mounted, so clean can find exactly this session later.
+func tagSession(pod *corev1.Pod, state *MountState) error {
+	hostName, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("failed to determine hostname: %v", err)
+	}
+	pod.Labels[MountIDLabel] = state.ID
+	pod.Annotations = map[string]string{
+		MountPointAnnotation: state.MountPoint,
+		HostNameAnnotation:   hostName,
+	}
+	return nil
+}
+
+func annotatePod(ctx context.Context, clientset kubernetes.Interface, namespace, podName, key, value string) error {
+	patchData, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{key: value},
+		},
 	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal annotation patch: %v", err)
+	}
+	_, err = clientset.CoreV1().Pods(namespace).Patch(ctx, podName, types.MergePatchType, patchData, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to annotate pod %s: %v", podName, err)
+	}
+	return nil
 }
 
-func setupPortForwarding(namespace, podName string, port int) error {
-	cmd := exec.Command("kubectl", "port-forward", fmt.Sprintf("pod/%s", podName), fmt.Sprintf("%d:%d", port, DefaultSSHPort), "-n", namespace)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start port-forward: %v", err)
+// waitForSession makes sure sshd answers through the port-forward, and for
+// ephemeral containers through the tunnel, before sshfs tries to log in.
+func waitForSession(ctx context.Context, restConfig *rest.Config, clientset kubernetes.Interface, state *MountState) error {
+	err := waitForSSHBanner(ctx, state.LocalPort, sshBannerTimeout)
+	if err == nil || state.EphemeralContainer == "" {
+		return err
 	}
-	time.Sleep(5 * time.Second) // Wait a bit for the port forwarding to establish
+	if logs := tunnelLogs(ctx, restConfig, clientset, state.Namespace, state.TargetPodName, state.EphemeralContainer); logs != "" {
+		return fmt.Errorf("the tunnel from ephemeral container %s did not come up: %v\nTunnel logs:\n%s", state.EphemeralContainer, err, logs)
+	}
+	return fmt.Errorf("the tunnel from ephemeral container %s did not come up: %v", state.EphemeralContainer, err)
+}
+
+// setupPortForwarding starts the background port-forward, which also renews
+// the session Lease when there is one.
+func setupPortForwarding(ctx context.Context, configFlags *genericclioptions.ConfigFlags, state *MountState, renewLease bool) error {
+	mountID := ""
+	if renewLease {
+		mountID = state.ID
+	}
+	pid, port, err := startPortForwarder(ctx, configFlags, state.Namespace, state.PodName, mountID, DefaultSSHPort)
+	if err != nil {
+		return err
+	}
+	state.PortForwardPID = pid
+	state.LocalPort = port
 	return nil
 }
 
 func mountPVCOverSSH(
+	ctx context.Context,
 	port int,
-	localMountPoint, pvcName, privateKey string,
-	needsRoot bool) error {
+	localMountPoint, source, privateKey, knownHostsFile, hostKeyAlias, subPath string,
+	useAgent, needsRoot, readOnly bool) error {
 
-	// Create a temporary file to store the private key
-	tmpFile, err := os.CreateTemp("", "ssh_key_*.pem")
+	// sshfs only needs the key to log in, it's gone once it daemonizes
+	identity, cleanup, err := stageSessionKey(privateKey, useAgent)
 	if err != nil {
-		return fmt.Errorf("failed to create temporary file for SSH private key: %v", err)
+		return err
 	}
-	defer os.Remove(tmpFile.Name())
+	defer cleanup()
 
-	if _, err := tmpFile.Write([]byte(privateKey)); err != nil {
-		return fmt.Errorf("failed to write SSH private key to temporary file: %v", err)
-	}
-	if err := tmpFile.Close(); err != nil {
-		return fmt.Errorf("failed to close temporary file: %v", err)
+	sshfsCmd := exec.CommandContext(ctx, "sshfs", buildSSHFSArgs(port, localMountPoint, identity, knownHostsFile, hostKeyAlias, remoteVolumePath(subPath), needsRoot, readOnly)...)
+
+	sshfsCmd.Stdout = os.Stdout
+	sshfsCmd.Stderr = os.Stderr
+
+	if err := sshfsCmd.Run(); err != nil {
+		return fmt.Errorf("failed to mount PVC using SSHFS: %v", err)
 	}
 
+	fmt.Printf("%s mounted successfully to %s\n", source, localMountPoint)
+	return nil
+}
+
+// buildSSHFSArgs pins the session host key: whatever answers on the local
+// port has to present exactly the key that was handed to the pod.
+func buildSSHFSArgs(port int, localMountPoint string, identity sshIdentity, knownHostsFile, hostKeyAlias, remotePath string, needsRoot, readOnly bool) []string {
 	sshUser := "ve"
 	if needsRoot {
 		sshUser = "root"
 	}
 
-	sshfsCmd := exec.Command(
-		"sshfs",
-		"-o", fmt.Sprintf("IdentityFile=%s", tmpFile.Name()),
-		"-o", "StrictHostKeyChecking=no",
-		"-o", "UserKnownHostsFile=/dev/null",
+	args := append(identity.options(),
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", fmt.Sprintf("UserKnownHostsFile=%s", knownHostsFile),
+		"-o", fmt.Sprintf("HostKeyAlias=%s", hostKeyAlias),
 		"-o", "nomap=ignore",
-		fmt.Sprintf("%s@localhost:/volume", sshUser),
+	)
+	if readOnly {
+		args = append(args, "-o", "ro")
+	}
+	return append(args,
+		fmt.Sprintf("%s@localhost:%s", sshUser, remotePath),
 		localMountPoint,
 		"-p", fmt.Sprintf("%d", port),
 	)
-
-	sshfsCmd.Stdout = os.Stdout
-	sshfsCmd.Stderr = os.Stderr
-
-	if err := sshfsCmd.Run(); err != nil {
-		return fmt.Errorf("failed to mount PVC using SSHFS: %v", err)
-	}
-
-	fmt.Printf("PVC %s mounted successfully to %s\n", pvcName, localMountPoint)
-	return nil
 }
 
-func generatePodNameAndPort(role string) (string, int) {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+func generatePodName(role string) string {
 	suffix := randSeq(5)
 	baseName := "volume-exposer"
-	if role == "proxy" {
+	switch role {
+	case "proxy":
 		baseName = "volume-exposer-proxy"
+	case "inspect":
+		baseName = "volume-exposer-inspect"
 	}
-	podName := fmt.Sprintf("%s-%s", baseName, suffix)
-	port := r.Intn(64511) + 1024 // Use the local random generator
-	return podName, port
+	return fmt.Sprintf("%s-%s", baseName, suffix)
 }
 
-func createPodSpec(podName string, port int, pvcName, publicKey, role string, sshPort int, originalPodName string, needsRoot bool) *corev1.Pod {
+func createPodSpec(podName string, pvcName, secretName, role string, sshPort int, originalPodName, nodeName, subPath string, needsRoot, readOnly bool) *corev1.Pod {
 
 	envVars := []corev1.EnvVar{
-		{Name: "SSH_PUBLIC_KEY", Value: publicKey},
+		secretEnvVar("SSH_PUBLIC_KEY", secretName, PublicKeySecretKey),
+		secretEnvVar("SSH_HOST_KEY", secretName, HostKeySecretKey),
 		{Name: "SSH_PORT", Value: fmt.Sprintf("%d", sshPort)},
 		{Name: "NEEDS_ROOT", Value: fmt.Sprintf("%v", needsRoot)},
 	}
@@ -386,9 +762,8 @@ func createPodSpec(podName string, port int, pvcName, publicKey, role string, ss
 	}
 
 	labels := map[string]string{
-		"app":        "volume-exposer",
-		"pvcName":    pvcName,
-		"portNumber": fmt.Sprintf("%d", port),
+		"app":     "volume-exposer",
+		"pvcName": pvcName,
 	}
 
 	// Add the original pod name label if provided
@@ -411,10 +786,36 @@ func createPodSpec(podName string, port int, pvcName, publicKey, role string, ss
 		},
 	}
 
-	// Only mount the volume if the role is not "proxy"
+	// Pin the pod to the node where the volume is already attached. Like
+	// kubectl debug node, tolerate every taint: the workload already runs there.
+	if nodeName != "" {
+		podSpec.Spec.Affinity = &corev1.Affinity{
+			NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{
+						{
+							MatchFields: []corev1.NodeSelectorRequirement{
+								{
+									Key:      "metadata.name",
+									Operator: corev1.NodeSelectorOpIn,
+									Values:   []string{nodeName},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+		podSpec.Spec.Tolerations = []corev1.Toleration{
+			{Operator: corev1.TolerationOpExists},
+		}
+	}
+
+	// Only mount the volume if the role is not "proxy". With a sub-path, only
+	// that directory of the volume ends up in the pod.
 	if role != "proxy" {
 		container.VolumeMounts = []corev1.VolumeMount{
-			{MountPath: "/volume", Name: "my-pvc"},
+			{MountPath: remoteVolumePath(subPath), Name: "my-pvc", SubPath: subPath, ReadOnly: readOnly},
 		}
 		podSpec.Spec.Volumes = []corev1.Volume{
 			{
@@ -422,6 +823,7 @@ func createPodSpec(podName string, port int, pvcName, publicKey, role string, ss
 				VolumeSource: corev1.VolumeSource{
 					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
 						ClaimName: pvcName,
+						ReadOnly:  readOnly,
 					},
 				},
 			},
@@ -433,15 +835,6 @@ func createPodSpec(podName string, port int, pvcName, publicKey, role string, ss
 	return podSpec
 }
 
-func getPVCVolumeName(pod *corev1.Pod) (string, error) {
-	for _, volume := range pod.Spec.Volumes {
-		if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName != "" {
-			return volume.Name, nil
-		}
-	}
-	return "", fmt.Errorf("failed to find volume name in the existing pod")
-}
-
 func getEphemeralContainerSettings(needsRoot bool) (string, *corev1.SecurityContext) {
 	image := Image
 	var securityContext *corev1.SecurityContext
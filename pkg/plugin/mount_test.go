@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
@@ -126,6 +127,90 @@ func TestGetPodIP(t *testing.T) {
 	})
 }
 
+func TestCreatePodSpecReadOnly(t *testing.T) {
+	podSpec := createPodSpec("test-pod", "test-pvc", "volume-exposer-abcdefgh", "standalone", 22, "", "", "", false, true)
+	if !podSpec.Spec.Volumes[0].PersistentVolumeClaim.ReadOnly {
+		t.Error("Expected the PVC volume source to be read-only")
+	}
+	if !podSpec.Spec.Containers[0].VolumeMounts[0].ReadOnly {
+		t.Error("Expected the volume mount to be read-only")
+	}
+}
+
+func TestCreateEphemeralContainerSpecReadOnly(t *testing.T) {
+	container := createEphemeralContainerSpec("volume-exposer-ephemeral-abcde", "data", "volume-exposer-abcdefgh", "10.0.0.1", nil, false, true)
+	if len(container.VolumeMounts) != 1 || container.VolumeMounts[0].Name != "data" {
+		t.Fatalf("Expected the data volume to be mounted, got %+v", container.VolumeMounts)
+	}
+	if !container.VolumeMounts[0].ReadOnly {
+		t.Error("Expected the ephemeral container mount to be read-only")
+	}
+}
+
+func TestBuildSSHFSArgs(t *testing.T) {
+	args := strings.Join(buildSSHFSArgs(40000, "/mnt/data", sshIdentity{file: "/tmp/key"}, "/tmp/known_hosts", "volume-exposer-abcdefgh", "/volume", false, false), " ")
+	if strings.Contains(args, "-o ro") {
+		t.Errorf("Expected a writable mount, got %s", args)
+	}
+	if strings.Contains(args, "StrictHostKeyChecking=no") || !strings.Contains(args, "UserKnownHostsFile=/tmp/known_hosts -o HostKeyAlias=volume-exposer-abcdefgh") {
+		t.Errorf("Expected the session host key to be pinned, got %s", args)
+	}
+	if !strings.Contains(args, "ve@localhost:/volume /mnt/data -p 40000") {
+		t.Errorf("Unexpected sshfs target in %s", args)
+	}
+
+	args = strings.Join(buildSSHFSArgs(40000, "/mnt/data", sshIdentity{file: "/tmp/key"}, "/tmp/known_hosts", "volume-exposer-abcdefgh", "/volume/app", true, true), " ")
+	if !strings.Contains(args, "-o ro") {
+		t.Errorf("Expected a read-only mount, got %s", args)
+	}
+	if !strings.Contains(args, "root@localhost:/volume/app /mnt/data") {
+		t.Errorf("Expected the root user, got %s", args)
+	}
+}
+
+func TestCreatePodSpecSubPath(t *testing.T) {
+	podSpec := createPodSpec("test-pod", "test-pvc", "volume-exposer-abcdefgh", "standalone", 22, "", "", "app/data", false, false)
+	mount := podSpec.Spec.Containers[0].VolumeMounts[0]
+	if mount.SubPath != "app/data" {
+		t.Errorf("Expected subPath app/data, got %q", mount.SubPath)
+	}
+	if mount.MountPath != "/volume/app/data" {
+		t.Errorf("Expected mount path /volume/app/data, got %q", mount.MountPath)
+	}
+}
+
+func TestCleanSubPath(t *testing.T) {
+	tests := []struct {
+		subPath string
+		want    string
+		wantErr bool
+	}{
+		{subPath: "", want: ""},
+		{subPath: ".", want: ""},
+		{subPath: "app", want: "app"},
+		{subPath: "app/./data/", want: "app/data"},
+		{subPath: "app/../other", want: "other"},
+		{subPath: "/app", wantErr: true},
+		{subPath: "..", wantErr: true},
+		{subPath: "app/../../etc", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := cleanSubPath(tt.subPath)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("cleanSubPath(%q) should have returned an error", tt.subPath)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("cleanSubPath(%q) returned an error: %v", tt.subPath, err)
+		}
+		if got != tt.want {
+			t.Errorf("cleanSubPath(%q) = %q; want %q", tt.subPath, got, tt.want)
+		}
+	}
+}
+
 func TestContains(t *testing.T) {
 	modes := []corev1.PersistentVolumeAccessMode{
 		corev1.ReadWriteOnce,
@@ -139,29 +224,62 @@ func TestContains(t *testing.T) {
 	}
 }
 
-func TestGeneratePodNameAndPort(t *testing.T) {
-	name1, port1 := generatePodNameAndPort("standalone")
-	name2, port2 := generatePodNameAndPort("standalone")
+func TestGeneratePodName(t *testing.T) {
+	name1 := generatePodName("standalone")
+	name2 := generatePodName("standalone")
 	if name1 == name2 {
 		t.Error("Expected different pod names")
 	}
-	if port1 == port2 {
-		t.Error("Expected different ports")
+	if !strings.HasPrefix(generatePodName("proxy"), "volume-exposer-proxy-") {
+		t.Error("Expected proxy pod name prefix")
 	}
 }
 
 func TestCreatePodSpec(t *testing.T) {
-	podSpec := createPodSpec("test-pod", 12345, "test-pvc", "publicKey", "standalone", 22, "", false)
+	podSpec := createPodSpec("test-pod", "test-pvc", "volume-exposer-abcdefgh", "standalone", 22, "", "", "", false, false)
 	if podSpec.Name != "test-pod" {
 		t.Errorf("Expected pod name 'test-pod', got '%s'", podSpec.Name)
 	}
+	if podSpec.Spec.Affinity != nil {
+		t.Error("Expected no node affinity for an unpinned pod")
+	}
 	// Additional checks for volumes, containers, etc.
 }
 
-func TestGetPVCVolumeName(t *testing.T) {
+func TestCreatePodSpecPinnedToNode(t *testing.T) {
+	podSpec := createPodSpec("test-pod", "test-pvc", "volume-exposer-abcdefgh", "standalone", 22, "", "node-1", "", false, false)
+	if podSpec.Spec.Affinity == nil || podSpec.Spec.Affinity.NodeAffinity == nil {
+		t.Fatal("Expected node affinity to be set")
+	}
+	terms := podSpec.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	if len(terms) != 1 || len(terms[0].MatchFields) != 1 {
+		t.Fatalf("Expected a single metadata.name match, got %+v", terms)
+	}
+	field := terms[0].MatchFields[0]
+	if field.Key != "metadata.name" || len(field.Values) != 1 || field.Values[0] != "node-1" {
+		t.Errorf("Expected pod pinned to node-1, got %+v", field)
+	}
+	if len(podSpec.Spec.Tolerations) != 1 || podSpec.Spec.Tolerations[0].Operator != corev1.TolerationOpExists {
+		t.Errorf("Expected pinned pod to tolerate all taints, got %+v", podSpec.Spec.Tolerations)
+	}
+	if len(podSpec.Spec.Volumes) != 1 || podSpec.Spec.Volumes[0].PersistentVolumeClaim.ClaimName != "test-pvc" {
+		t.Errorf("Expected the PVC to be mounted, got %+v", podSpec.Spec.Volumes)
+	}
+}
+
+func TestPodVolumeName(t *testing.T) {
 	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app"},
 		Spec: corev1.PodSpec{
 			Volumes: []corev1.Volume{
+				{
+					Name: "other-volume",
+					VolumeSource: corev1.VolumeSource{
+						PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+							ClaimName: "other-pvc",
+						},
+					},
+				},
 				{
 					Name: "test-volume",
 					VolumeSource: corev1.VolumeSource{
@@ -173,11 +291,40 @@ func TestGetPVCVolumeName(t *testing.T) {
 			},
 		},
 	}
-	volumeName, err := getPVCVolumeName(pod)
+	volumeName, err := podVolumeName(pod, "test-pvc", "")
 	if err != nil {
-		t.Errorf("getPVCVolumeName returned an error: %v", err)
+		t.Errorf("podVolumeName returned an error: %v", err)
 	}
 	if volumeName != "test-volume" {
 		t.Errorf("Expected volume name 'test-volume', got '%s'", volumeName)
 	}
+	if _, err := podVolumeName(pod, "missing-pvc", ""); err == nil {
+		t.Error("Expected an error for a PVC the pod doesn't use")
+	}
+	if volumeName, err := podVolumeName(pod, "", "other-volume"); err != nil || volumeName != "other-volume" {
+		t.Errorf("Expected the named volume, got %q, %v", volumeName, err)
+	}
+	if _, err := podVolumeName(pod, "", "missing-volume"); err == nil {
+		t.Error("Expected an error for a volume the pod doesn't have")
+	}
+}
+
+func TestTagSession(t *testing.T) {
+	pod := createPodSpec("test-pod", "test-pvc", "volume-exposer-abcdefgh", "standalone", 22, "", "", "", false, false)
+	state := &MountState{ID: "abc12345", MountPoint: "/mnt/data"}
+	if err := tagSession(pod, state); err != nil {
+		t.Fatalf("tagSession returned an error: %v", err)
+	}
+	if pod.Labels[MountIDLabel] != "abc12345" {
+		t.Errorf("Expected mount ID label abc12345, got %q", pod.Labels[MountIDLabel])
+	}
+	if pod.Labels["pvcName"] != "test-pvc" {
+		t.Errorf("Expected existing labels to be kept, got %v", pod.Labels)
+	}
+	if pod.Annotations[MountPointAnnotation] != "/mnt/data" {
+		t.Errorf("Expected mount point annotation /mnt/data, got %q", pod.Annotations[MountPointAnnotation])
+	}
+	if pod.Annotations[HostNameAnnotation] == "" {
+		t.Error("Expected host name annotation to be set")
+	}
 }
@@ -0,0 +1,141 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// volumeOwner is the owner of the mounted directory, as seen from a pod.
+type volumeOwner struct {
+	uid int64
+	gid int64
+}
+
+// detectVolumeOwner runs a short-lived pod that stats the directory that is
+// going to be mounted and reports its owner. The pod is pinned like the
+// exposer and removed before returning, so ReadWriteOncePod volumes are free
+// again for the exposer.
+func detectVolumeOwner(ctx context.Context, clientset kubernetes.Interface, namespace, pvcName, nodeName, subPath string, timeout time.Duration) (*volumeOwner, error) {
+	podName := generatePodName("inspect")
+	pod := createInspectionPodSpec(podName, pvcName, nodeName, subPath)
+	if _, err := clientset.CoreV1().Pods(namespace).Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		return nil, fmt.Errorf("failed to create inspection pod: %v", admissionFailure(err, namespace, false))
+	}
+	fmt.Printf("Inspection pod %s created successfully\n", podName)
+	// Clean up even when the mount was interrupted
+	defer deletePodAndWait(context.WithoutCancel(ctx), clientset, namespace, podName)
+
+	if err := waitForPodCompletion(ctx, clientset, namespace, podName, timeout); err != nil {
+		return nil, err
+	}
+
+	logs, err := clientset.CoreV1().Pods(namespace).GetLogs(podName, &corev1.PodLogOptions{}).DoRaw(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the output of inspection pod %s: %v", podName, err)
+	}
+	owner, err := parseVolumeOwner(string(logs))
+	if err != nil {
+		return nil, err
+	}
+	if owner.uid == 0 {
+		return nil, fmt.Errorf("%s is owned by root, use --needs-root instead of --as-owner", remoteVolumePath(subPath))
+	}
+	fmt.Printf("Volume is owned by %d:%d\n", owner.uid, owner.gid)
+	return owner, nil
+}
+
+// createInspectionPodSpec reuses the exposer spec, minus sshd: the container
+// only prints the owner of the volume read-only and exits.
+func createInspectionPodSpec(podName, pvcName, nodeName, subPath string) *corev1.Pod {
+	pod := createPodSpec(podName, pvcName, "", "inspect", DefaultSSHPort, "", nodeName, subPath, false, true)
+	pod.Spec.RestartPolicy = corev1.RestartPolicyNever
+	container := &pod.Spec.Containers[0]
+	container.Command = []string{"stat", "-c", "%u:%g", remoteVolumePath(subPath)}
+	container.Ports = nil
+	container.Env = nil
+	return pod
+}
+
+// parseVolumeOwner parses the "uid:gid" printed by the inspection pod.
+func parseVolumeOwner(output string) (*volumeOwner, error) {
+	uidStr, gidStr, ok := strings.Cut(strings.TrimSpace(output), ":")
+	if !ok {
+		return nil, fmt.Errorf("unexpected output from inspection pod: %q", output)
+	}
+	uid, err := strconv.ParseInt(uidStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UID %q from inspection pod: %v", uidStr, err)
+	}
+	gid, err := strconv.ParseInt(gidStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GID %q from inspection pod: %v", gidStr, err)
+	}
+	return &volumeOwner{uid: uid, gid: gid}, nil
+}
+
+// apply runs the exposer as the owner. fsGroup is deliberately left alone:
+// it would make the kubelet chown the whole volume.
+func (o *volumeOwner) apply(pod *corev1.Pod) {
+	pod.Spec.SecurityContext.RunAsUser = &o.uid
+	pod.Spec.SecurityContext.RunAsGroup = &o.gid
+}
+
+// waitForPodCompletion waits up to timeout for the inspection pod to exit,
+// failing early when it can't start, like the exposer pods do.
+func waitForPodCompletion(ctx context.Context, clientset kubernetes.Interface, namespace, podName string, timeout time.Duration) error {
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var lastPod *corev1.Pod
+	var lastEvents []corev1.Event
+	err := waitForPod(waitCtx, clientset, namespace, podName, true, func(pod *corev1.Pod, events []corev1.Event) (bool, error) {
+		lastPod, lastEvents = pod, events
+		switch pod.Status.Phase {
+		case corev1.PodSucceeded:
+			return true, nil
+		case corev1.PodFailed:
+			return false, fmt.Errorf("inspection pod %s failed", podName)
+		}
+		if failure := podStartFailure(pod, events); failure != nil {
+			return false, failure
+		}
+		return false, nil
+	})
+	if waitCtx.Err() != nil && ctx.Err() == nil {
+		if lastPod == nil {
+			return fmt.Errorf("inspection pod %s didn't finish within %s, it was never seen", podName, timeout)
+		}
+		return fmt.Errorf("inspection pod %s didn't finish within %s: %s", podName, timeout, describePodProgress(lastPod, lastEvents))
+	}
+	return err
+}
+
+// deletePodAndWait removes a pod and waits until it's gone. It's best effort,
+// any leftover is reported but doesn't fail the mount.
+func deletePodAndWait(ctx context.Context, clientset kubernetes.Interface, namespace, podName string) {
+	gracePeriod := int64(0)
+	err := clientset.CoreV1().Pods(namespace).Delete(ctx, podName, metav1.DeleteOptions{GracePeriodSeconds: &gracePeriod})
+	if err != nil && !apierrors.IsNotFound(err) {
+		fmt.Printf("Warning: failed to delete pod %s: %v\n", podName, err)
+		return
+	}
+	err = wait.PollUntilContextTimeout(ctx, time.Second, time.Minute, true, func(ctx context.Context) (bool, error) {
+		_, err := clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	})
+	if err != nil {
+		fmt.Printf("Warning: pod %s is still around: %v\n", podName, err)
+	}
+}
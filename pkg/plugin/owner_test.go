@@ -0,0 +1,91 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseVolumeOwner(t *testing.T) {
+	tests := []struct {
+		output  string
+		uid     int64
+		gid     int64
+		wantErr bool
+	}{
+		{output: "999:999\n", uid: 999, gid: 999},
+		{output: "1000650000:0", uid: 1000650000, gid: 0},
+		{output: "", wantErr: true},
+		{output: "stat: cannot stat '/volume': No such file or directory", wantErr: true},
+		{output: "abc:1", wantErr: true},
+	}
+	for _, tt := range tests {
+		owner, err := parseVolumeOwner(tt.output)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseVolumeOwner(%q) should have returned an error", tt.output)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseVolumeOwner(%q) returned error: %v", tt.output, err)
+			continue
+		}
+		if owner.uid != tt.uid || owner.gid != tt.gid {
+			t.Errorf("parseVolumeOwner(%q) = %d:%d, want %d:%d", tt.output, owner.uid, owner.gid, tt.uid, tt.gid)
+		}
+	}
+}
+
+func TestCreateInspectionPodSpec(t *testing.T) {
+	pod := createInspectionPodSpec("volume-exposer-inspect-abcde", "test-pvc", "node-1", "app")
+	if pod.Spec.RestartPolicy != corev1.RestartPolicyNever {
+		t.Errorf("Expected restart policy Never, got %s", pod.Spec.RestartPolicy)
+	}
+	container := pod.Spec.Containers[0]
+	if got := strings.Join(container.Command, " "); got != "stat -c %u:%g /volume/app" {
+		t.Errorf("Unexpected command %q", got)
+	}
+	if len(container.Ports) != 0 || len(container.Env) != 0 {
+		t.Errorf("Expected no ports or env, got %+v", container)
+	}
+	if !container.VolumeMounts[0].ReadOnly {
+		t.Error("Expected the volume to be mounted read-only")
+	}
+	if pod.Spec.Affinity == nil {
+		t.Error("Expected the inspection pod to be pinned to the node")
+	}
+}
+
+func TestVolumeOwnerApply(t *testing.T) {
+	pod := createPodSpec("test-pod", "test-pvc", "volume-exposer-abcdefgh", "standalone", 22, "", "", "", false, false)
+	owner := &volumeOwner{uid: 999, gid: 1000}
+	owner.apply(pod)
+	sc := pod.Spec.SecurityContext
+	if *sc.RunAsUser != 999 || *sc.RunAsGroup != 1000 {
+		t.Errorf("Expected to run as 999:1000, got %d:%d", *sc.RunAsUser, *sc.RunAsGroup)
+	}
+	if sc.FSGroup != nil {
+		t.Error("Expected fsGroup to stay unset")
+	}
+}
+
+func TestWaitForPodCompletionTimeout(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "volume-exposer-inspect-abcde", Namespace: "default"},
+		Status:     corev1.PodStatus{Phase: corev1.PodPending},
+	}
+	start := time.Now()
+	err := waitForPodCompletion(context.Background(), fake.NewSimpleClientset(pod), "default", pod.Name, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "didn't finish within 1s") {
+		t.Errorf("Expected the timeout to be reported, got %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Errorf("Expected the timeout to be honored, took %s", time.Since(start))
+	}
+}
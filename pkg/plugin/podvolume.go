@@ -0,0 +1,153 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// PodPrefix marks a mount target that names a pod instead of a PVC, as in
+// pod/web-0.
+const PodPrefix = "pod/"
+
+// Volume types the kubelet always mounts read-only.
+var readOnlyVolumeTypes = map[string]bool{
+	"configMap":   true,
+	"secret":      true,
+	"downwardAPI": true,
+	"projected":   true,
+	"image":       true,
+}
+
+// resolvePodVolume returns pod podName and its volume volumeName. Without a
+// volume name, the only volume that isn't the service account token is
+// taken.
+func resolvePodVolume(ctx context.Context, clientset kubernetes.Interface, namespace, podName, volumeName string) (*corev1.Pod, *corev1.Volume, error) {
+	pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get pod: %v", err)
+	}
+
+	if volumeName != "" {
+		for i := range pod.Spec.Volumes {
+			if pod.Spec.Volumes[i].Name == volumeName {
+				return pod, &pod.Spec.Volumes[i], nil
+			}
+		}
+		return nil, nil, fmt.Errorf("pod %s has no volume %s, it has:%s", podName, volumeName, describeVolumes(pod))
+	}
+
+	var candidates []*corev1.Volume
+	for i := range pod.Spec.Volumes {
+		if !serviceAccountTokenVolume(&pod.Spec.Volumes[i]) {
+			candidates = append(candidates, &pod.Spec.Volumes[i])
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil, nil, fmt.Errorf("pod %s has no volumes to mount", podName)
+	case 1:
+		fmt.Printf("Using volume %s, the only volume of pod %s\n", candidates[0].Name, podName)
+		return pod, candidates[0], nil
+	}
+	return nil, nil, fmt.Errorf("pod %s has several volumes, pick one with --volume:%s", podName, describeVolumes(pod))
+}
+
+// serviceAccountTokenVolume reports whether volume is the API access volume
+// the service account admission adds to every pod.
+func serviceAccountTokenVolume(volume *corev1.Volume) bool {
+	return volume.Projected != nil && strings.HasPrefix(volume.Name, "kube-api-access-")
+}
+
+// volumeClaimName returns the PVC behind volume of pod, or nothing when it
+// isn't backed by one.
+func volumeClaimName(pod *corev1.Pod, volume *corev1.Volume) string {
+	switch {
+	case volume.PersistentVolumeClaim != nil:
+		return volume.PersistentVolumeClaim.ClaimName
+	case volume.Ephemeral != nil:
+		// Generic ephemeral volumes get a PVC named after the pod and volume
+		return pod.Name + "-" + volume.Name
+	}
+	return ""
+}
+
+// volumeType names the source of volume the way the pod spec does.
+func volumeType(volume *corev1.Volume) string {
+	source := volume.VolumeSource
+	switch {
+	case source.PersistentVolumeClaim != nil:
+		return "persistentVolumeClaim"
+	case source.Ephemeral != nil:
+		return "ephemeral"
+	case source.EmptyDir != nil:
+		return "emptyDir"
+	case source.ConfigMap != nil:
+		return "configMap"
+	case source.Secret != nil:
+		return "secret"
+	case source.HostPath != nil:
+		return "hostPath"
+	case source.CSI != nil:
+		return "csi"
+	case source.Projected != nil:
+		return "projected"
+	case source.DownwardAPI != nil:
+		return "downwardAPI"
+	case source.NFS != nil:
+		return "nfs"
+	case source.Image != nil:
+		return "image"
+	}
+	return "other"
+}
+
+func describeVolumes(pod *corev1.Pod) string {
+	var b strings.Builder
+	for i := range pod.Spec.Volumes {
+		volume := &pod.Spec.Volumes[i]
+		fmt.Fprintf(&b, "\n  %s (%s)", volume.Name, volumeType(volume))
+	}
+	return b.String()
+}
+
+// planPodVolume plans the mount of a pod volume that isn't backed by a PVC.
+// Only the pod itself can reach it, so it always goes through an ephemeral
+// container.
+func planPodVolume(pod *corev1.Pod, volume *corev1.Volume) (accessPlan, error) {
+	kind := volumeType(volume)
+	if pod.Status.Phase != corev1.PodRunning {
+		return accessPlan{}, fmt.Errorf("volume %s of pod %s is a %s volume that only the pod can reach, but the pod is %s; an ephemeral container can only be added to a running pod", volume.Name, pod.Name, kind, podPhase(pod))
+	}
+	plan := accessPlan{
+		strategy:    strategyEphemeral,
+		podUsingPVC: pod.Name,
+		readOnly:    readOnlyVolumeTypes[kind],
+		reason:      fmt.Sprintf("Volume %s of pod %s is a %s volume, mounting it through an ephemeral container", volume.Name, pod.Name, kind),
+	}
+	if plan.readOnly {
+		plan.reason += ", read-only"
+	}
+	return plan, nil
+}
+
+// podVolumeName returns the volume of pod to mount in the ephemeral
+// container: volumeName when given, or else the one backed by the PVC.
+func podVolumeName(pod *corev1.Pod, pvcName, volumeName string) (string, error) {
+	if volumeName != "" {
+		for _, volume := range pod.Spec.Volumes {
+			if volume.Name == volumeName {
+				return volumeName, nil
+			}
+		}
+		return "", fmt.Errorf("pod %s has no volume %s", pod.Name, volumeName)
+	}
+	if volumeName, ok := pvcVolume(pod, pvcName); ok {
+		return volumeName, nil
+	}
+	return "", fmt.Errorf("pod %s has no volume backed by PVC %s", pod.Name, pvcName)
+}
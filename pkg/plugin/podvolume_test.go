@@ -0,0 +1,86 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestResolvePodVolume(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		pod     *corev1.Pod
+		volume  string
+		want    string
+		wantErr string
+	}{
+		{name: "named volume", pod: testPod("web-0", inPhase(corev1.PodRunning), withVolumes(tokenVolume, cacheVolume, configVolume)), volume: "config", want: "config"},
+		{name: "missing volume", pod: testPod("web-0", inPhase(corev1.PodRunning), withVolumes(tokenVolume, cacheVolume)), volume: "config", wantErr: "cache (emptyDir)"},
+		{name: "only volume besides the token", pod: testPod("web-0", inPhase(corev1.PodRunning), withVolumes(tokenVolume, cacheVolume)), want: "cache"},
+		{name: "several volumes", pod: testPod("web-0", inPhase(corev1.PodRunning), withVolumes(tokenVolume, cacheVolume, dataVolume)), wantErr: "--volume"},
+		{name: "no volumes", pod: testPod("web-0", inPhase(corev1.PodRunning), withVolumes(tokenVolume)), wantErr: "no volumes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, volume, err := resolvePodVolume(ctx, fake.NewSimpleClientset(tt.pod), "default", "web-0", tt.volume)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Expected an error with %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolvePodVolume returned an error: %v", err)
+			}
+			if volume.Name != tt.want {
+				t.Errorf("Expected volume %s, got %s", tt.want, volume.Name)
+			}
+		})
+	}
+
+	if _, _, err := resolvePodVolume(ctx, fake.NewSimpleClientset(), "default", "web-0", "data"); err == nil {
+		t.Error("Expected an error for a missing pod")
+	}
+}
+
+func TestVolumeClaimName(t *testing.T) {
+	pod := testPod("web-0", inPhase(corev1.PodRunning))
+	for _, tt := range []struct {
+		volume corev1.Volume
+		want   string
+	}{
+		{volume: dataVolume, want: "data-web-0"},
+		{volume: tmpVolume, want: "web-0-scratch"},
+		{volume: cacheVolume, want: ""},
+	} {
+		if got := volumeClaimName(pod, &tt.volume); got != tt.want {
+			t.Errorf("volumeClaimName(%s) = %q, want %q", tt.volume.Name, got, tt.want)
+		}
+	}
+}
+
+func TestPlanPodVolume(t *testing.T) {
+	plan, err := planPodVolume(testPod("web-0", inPhase(corev1.PodRunning), withVolumes(cacheVolume)), &cacheVolume)
+	if err != nil {
+		t.Fatalf("planPodVolume returned an error: %v", err)
+	}
+	if plan.strategy != strategyEphemeral || plan.podUsingPVC != "web-0" || plan.readOnly {
+		t.Errorf("Expected a writable ephemeral container in web-0, got %+v", plan)
+	}
+
+	plan, err = planPodVolume(testPod("web-0", inPhase(corev1.PodRunning), withVolumes(configVolume)), &configVolume)
+	if err != nil {
+		t.Fatalf("planPodVolume returned an error: %v", err)
+	}
+	if !plan.readOnly || !strings.Contains(plan.reason, "configMap") {
+		t.Errorf("Expected a read-only configMap mount, got %+v", plan)
+	}
+
+	if _, err := planPodVolume(testPod("web-0", inPhase(corev1.PodPending), withVolumes(cacheVolume)), &cacheVolume); err == nil {
+		t.Error("Expected an error for a pod that isn't running")
+	}
+}
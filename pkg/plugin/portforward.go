@@ -0,0 +1,349 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/httpstream"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/portforward"
+	"k8s.io/client-go/transport/spdy"
+)
+
+const (
+	portForwardReadyTimeout = time.Minute
+	// sshBannerTimeout bounds how long sshd may take to answer through a
+	// ready port-forward, e.g. while the tunnel from the ephemeral container
+	// connects.
+	sshBannerTimeout = time.Minute
+)
+
+// forwarderRequest is what Mount hands to the background port-forward
+// process over its stdin. Credentials given on the command line therefore
+// never show up in the process list for the lifetime of the mount.
+type forwarderRequest struct {
+	KubeFlags  kubeFlags `json:"kubeFlags"`
+	Namespace  string    `json:"namespace"`
+	PodName    string    `json:"podName"`
+	RemotePort int       `json:"remotePort"`
+	// MountID names the session Lease the process keeps renewing.
+	MountID string `json:"mountID,omitempty"`
+}
+
+// kubeFlags mirrors the serializable part of genericclioptions.ConfigFlags.
+type kubeFlags struct {
+	KubeConfig       string   `json:"kubeconfig,omitempty"`
+	ClusterName      string   `json:"cluster,omitempty"`
+	AuthInfoName     string   `json:"user,omitempty"`
+	Context          string   `json:"context,omitempty"`
+	APIServer        string   `json:"server,omitempty"`
+	TLSServerName    string   `json:"tlsServerName,omitempty"`
+	Insecure         bool     `json:"insecure,omitempty"`
+	CertFile         string   `json:"clientCertificate,omitempty"`
+	KeyFile          string   `json:"clientKey,omitempty"`
+	CAFile           string   `json:"certificateAuthority,omitempty"`
+	BearerToken      string   `json:"token,omitempty"`
+	Impersonate      string   `json:"as,omitempty"`
+	ImpersonateUID   string   `json:"asUID,omitempty"`
+	ImpersonateGroup []string `json:"asGroup,omitempty"`
+	Username         string   `json:"username,omitempty"`
+	Password         string   `json:"password,omitempty"`
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func kubeFlagsFrom(configFlags *genericclioptions.ConfigFlags) kubeFlags {
+	flags := kubeFlags{
+		KubeConfig:     stringValue(configFlags.KubeConfig),
+		ClusterName:    stringValue(configFlags.ClusterName),
+		AuthInfoName:   stringValue(configFlags.AuthInfoName),
+		Context:        stringValue(configFlags.Context),
+		APIServer:      stringValue(configFlags.APIServer),
+		TLSServerName:  stringValue(configFlags.TLSServerName),
+		CertFile:       stringValue(configFlags.CertFile),
+		KeyFile:        stringValue(configFlags.KeyFile),
+		CAFile:         stringValue(configFlags.CAFile),
+		BearerToken:    stringValue(configFlags.BearerToken),
+		Impersonate:    stringValue(configFlags.Impersonate),
+		ImpersonateUID: stringValue(configFlags.ImpersonateUID),
+		Username:       stringValue(configFlags.Username),
+		Password:       stringValue(configFlags.Password),
+	}
+	if configFlags.Insecure != nil {
+		flags.Insecure = *configFlags.Insecure
+	}
+	if configFlags.ImpersonateGroup != nil {
+		flags.ImpersonateGroup = *configFlags.ImpersonateGroup
+	}
+	return flags
+}
+
+func (f kubeFlags) toConfigFlags() *genericclioptions.ConfigFlags {
+	configFlags := genericclioptions.NewConfigFlags(true)
+	configFlags.KubeConfig = &f.KubeConfig
+	configFlags.ClusterName = &f.ClusterName
+	configFlags.AuthInfoName = &f.AuthInfoName
+	configFlags.Context = &f.Context
+	configFlags.APIServer = &f.APIServer
+	configFlags.TLSServerName = &f.TLSServerName
+	configFlags.Insecure = &f.Insecure
+	configFlags.CertFile = &f.CertFile
+	configFlags.KeyFile = &f.KeyFile
+	configFlags.CAFile = &f.CAFile
+	configFlags.BearerToken = &f.BearerToken
+	configFlags.Impersonate = &f.Impersonate
+	configFlags.ImpersonateUID = &f.ImpersonateUID
+	configFlags.ImpersonateGroup = &f.ImpersonateGroup
+	configFlags.Username = &f.Username
+	configFlags.Password = &f.Password
+	return configFlags
+}
+
+// portForwardPattern is matched against the command line of the background
+// port-forward process, which is how Clean finds it again.
+func portForwardPattern(podName string) string {
+	return fmt.Sprintf("port-forward pod/%s", podName)
+}
+
+// startPortForwarder re-executes the current binary as a detached
+// port-forward process, so the tunnel outlives this invocation the same way
+// the sshfs daemon does. It returns once the forwarder is listening, or
+// stops it when ctx is cancelled first.
+func startPortForwarder(ctx context.Context, configFlags *genericclioptions.ConfigFlags, namespace, podName, mountID string, remotePort int) (int, int, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to locate pv-mounter executable: %v", err)
+	}
+
+	request, err := json.Marshal(forwarderRequest{
+		KubeFlags:  kubeFlagsFrom(configFlags),
+		Namespace:  namespace,
+		PodName:    podName,
+		RemotePort: remotePort,
+		MountID:    mountID,
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to marshal port-forward request: %v", err)
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to create port-forward pipe: %v", err)
+	}
+	defer readyReader.Close()
+
+	cmd := exec.Command(self, "port-forward", "pod/"+podName)
+	cmd.Stdin = strings.NewReader(string(request))
+	cmd.ExtraFiles = []*os.File{readyWriter}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		readyWriter.Close()
+		return 0, 0, fmt.Errorf("failed to start port-forward: %v", err)
+	}
+	readyWriter.Close()
+
+	type result struct {
+		line string
+		err  error
+	}
+	lines := make(chan result, 1)
+	go func() {
+		line, err := bufio.NewReader(readyReader).ReadString('\n')
+		lines <- result{strings.TrimSpace(line), err}
+	}()
+
+	select {
+	case r := <-lines:
+		if port, ok := strings.CutPrefix(r.line, "ready "); ok {
+			localPort, err := strconv.Atoi(port)
+			if err == nil {
+				fmt.Printf("Forwarding from 127.0.0.1:%d to pod %s port %d\n", localPort, podName, remotePort)
+				return cmd.Process.Pid, localPort, nil
+			}
+		}
+		_ = cmd.Process.Kill()
+		if msg, ok := strings.CutPrefix(r.line, "error "); ok {
+			return 0, 0, fmt.Errorf("port-forward failed: %s", msg)
+		}
+		return 0, 0, fmt.Errorf("port-forward exited before becoming ready: %v", r.err)
+	case <-time.After(portForwardReadyTimeout):
+		_ = cmd.Process.Kill()
+		return 0, 0, fmt.Errorf("port-forward to pod %s did not become ready within %s", podName, portForwardReadyTimeout)
+	case <-ctx.Done():
+		_ = cmd.Process.Kill()
+		return 0, 0, ctx.Err()
+	}
+}
+
+// ServePortForward is the body of the background port-forward process. It
+// reads a forwarderRequest from in, forwards a free local port to the pod
+// and reports either "ready <port>" or "error <message>" on ready.
+func ServePortForward(ctx context.Context, in io.Reader, ready io.WriteCloser) error {
+	var request forwarderRequest
+	if err := json.NewDecoder(in).Decode(&request); err != nil {
+		return reportNotReady(ready, fmt.Errorf("failed to read port-forward request: %v", err))
+	}
+
+	configFlags := request.KubeFlags.toConfigFlags()
+	restConfig, err := configFlags.ToRESTConfig()
+	if err != nil {
+		return reportNotReady(ready, fmt.Errorf("failed to build Kubernetes config: %v", err))
+	}
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return reportNotReady(ready, fmt.Errorf("failed to create Kubernetes client: %v", err))
+	}
+
+	localPort, stop, errs, err := forwardInProcess(ctx, restConfig, clientset, request.Namespace, request.PodName, request.RemotePort)
+	if err != nil {
+		return reportNotReady(ready, err)
+	}
+	fmt.Fprintf(ready, "ready %d\n", localPort)
+	ready.Close()
+
+	// The forwarder lives exactly as long as the mount, so it's the heartbeat
+	if request.MountID != "" {
+		go keepLeaseAlive(ctx, clientset, request.Namespace, request.MountID)
+	}
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		stop()
+		return nil
+	}
+}
+
+// forwardInProcess forwards a free local port to remotePort of the pod from
+// this process and waits until the forwarding is ready. stop ends it; errs
+// reports when it ends by itself, e.g. because the pod went away.
+func forwardInProcess(ctx context.Context, restConfig *rest.Config, clientset kubernetes.Interface, namespace, podName string, remotePort int) (int, func(), <-chan error, error) {
+	stopChan := make(chan struct{})
+	readyChan := make(chan struct{})
+	forwarder, err := newPortForwarder(restConfig, clientset, namespace, podName, remotePort, stopChan, readyChan)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	var once sync.Once
+	stop := func() {
+		once.Do(func() { close(stopChan) })
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- forwarder.ForwardPorts()
+	}()
+
+	select {
+	case <-readyChan:
+	case err := <-errChan:
+		return 0, nil, nil, fmt.Errorf("failed to forward ports: %v", err)
+	case <-ctx.Done():
+		stop()
+		return 0, nil, nil, ctx.Err()
+	}
+
+	ports, err := forwarder.GetPorts()
+	if err != nil || len(ports) == 0 {
+		stop()
+		return 0, nil, nil, fmt.Errorf("failed to determine forwarded port: %v", err)
+	}
+	return int(ports[0].Local), stop, errChan, nil
+}
+
+func reportNotReady(ready io.WriteCloser, err error) error {
+	fmt.Fprintf(ready, "error %s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+	ready.Close()
+	return err
+}
+
+// newPortForwarder forwards a free local port on 127.0.0.1 to remotePort of
+// the pod. WebSockets are tried first, falling back to SPDY for API servers
+// that don't support tunneling port-forward over them yet.
+func newPortForwarder(restConfig *rest.Config, clientset kubernetes.Interface, namespace, podName string, remotePort int, stopChan <-chan struct{}, readyChan chan struct{}) (*portforward.PortForwarder, error) {
+	url := clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(podName).
+		SubResource("portforward").
+		URL()
+
+	transport, upgrader, err := spdy.RoundTripperFor(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SPDY transport: %v", err)
+	}
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, http.MethodPost, url)
+
+	websocketDialer, err := portforward.NewSPDYOverWebsocketDialer(url, restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create WebSocket dialer: %v", err)
+	}
+	dialer = portforward.NewFallbackDialer(websocketDialer, dialer, func(err error) bool {
+		return httpstream.IsUpgradeFailure(err) || httpstream.IsHTTPSProxyError(err)
+	})
+
+	ports := []string{fmt.Sprintf("0:%d", remotePort)}
+	forwarder, err := portforward.NewOnAddresses(dialer, []string{"127.0.0.1"}, ports, stopChan, readyChan, io.Discard, io.Discard)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create port-forward: %v", err)
+	}
+	return forwarder, nil
+}
+
+// waitForSSHBanner waits until an SSH server greets on the local port. The
+// port-forward accepts connections long before anything answers behind it.
+func waitForSSHBanner(ctx context.Context, port int, timeout time.Duration) error {
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	var lastErr error
+	err := wait.PollUntilContextTimeout(ctx, time.Second, timeout, true, func(ctx context.Context) (bool, error) {
+		lastErr = readSSHBanner(address)
+		return lastErr == nil, nil
+	})
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return fmt.Errorf("no SSH server answered on port %d within %s: %v", port, timeout, lastErr)
+	}
+	return nil
+}
+
+func readSSHBanner(address string) error {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("no banner: %v", err)
+	}
+	if !strings.HasPrefix(line, "SSH-") {
+		return fmt.Errorf("unexpected banner %q", strings.TrimSpace(line))
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type nopWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestKubeFlagsRoundTrip(t *testing.T) {
+	configFlags := newTestConfigFlags(t)
+	kubeContext, token, user, group := "prod", "abc", "jane", []string{"admins"}
+	configFlags.Context = &kubeContext
+	configFlags.BearerToken = &token
+	configFlags.Impersonate = &user
+	configFlags.ImpersonateGroup = &group
+
+	restored := kubeFlagsFrom(configFlags).toConfigFlags()
+	config, err := restored.ToRESTConfig()
+	if err != nil {
+		t.Fatalf("ToRESTConfig returned an error: %v", err)
+	}
+	if config.Host != "https://prod.example.com" {
+		t.Errorf("Expected prod server, got %s", config.Host)
+	}
+	if config.BearerToken != "abc" {
+		t.Errorf("Expected token to be carried over, got %q", config.BearerToken)
+	}
+	if config.Impersonate.UserName != "jane" {
+		t.Errorf("Expected impersonated user jane, got %q", config.Impersonate.UserName)
+	}
+	if len(config.Impersonate.Groups) != 1 || config.Impersonate.Groups[0] != "admins" {
+		t.Errorf("Expected impersonated group admins, got %v", config.Impersonate.Groups)
+	}
+}
+
+func TestServePortForwardInvalidRequest(t *testing.T) {
+	ready := nopWriteCloser{&bytes.Buffer{}}
+	err := ServePortForward(context.Background(), strings.NewReader("not json"), ready)
+	if err == nil {
+		t.Fatal("ServePortForward should have returned an error")
+	}
+	if !strings.HasPrefix(ready.String(), "error ") {
+		t.Errorf("Expected an error line on the ready pipe, got %q", ready.String())
+	}
+}
+
+func TestWaitForSSHBanner(t *testing.T) {
+	serve := func(t *testing.T, greeting string) int {
+		t.Helper()
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.Write([]byte(greeting))
+				conn.Close()
+			}
+		}()
+		return listener.Addr().(*net.TCPAddr).Port
+	}
+
+	ctx := context.Background()
+	if err := waitForSSHBanner(ctx, serve(t, "SSH-2.0-OpenSSH_9.2\r\n"), time.Second); err != nil {
+		t.Errorf("Expected the banner to be accepted, got %v", err)
+	}
+	// A port-forward with nothing behind it just hangs up
+	if err := waitForSSHBanner(ctx, serve(t, ""), 1500*time.Millisecond); err == nil {
+		t.Error("Expected an error when no SSH server answers")
+	}
+}
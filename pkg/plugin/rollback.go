@@ -0,0 +1,49 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// rollbackTimeout bounds the whole unwind, so a cluster that went away
+// doesn't keep a failed mount hanging.
+const rollbackTimeout = time.Minute
+
+// undoAction reverts one step of a mount.
+type undoAction struct {
+	description string
+	undo        func(ctx context.Context) error
+}
+
+// rollback is the stack of undo actions for everything a mount has created
+// so far, in the cluster and locally. It's unwound when the mount fails, and
+// at the end of a foreground mount.
+type rollback struct {
+	actions []undoAction
+}
+
+// add records how to revert the step that just succeeded.
+func (r *rollback) add(description string, undo func(ctx context.Context) error) {
+	r.actions = append(r.actions, undoAction{description: description, undo: undo})
+}
+
+// unwind reverts all recorded steps, newest first. It runs on a fresh context
+// because the mount's own one is usually what got cancelled. Failures are
+// reported and don't stop the remaining steps.
+func (r *rollback) unwind(ctx context.Context) {
+	if len(r.actions) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rollbackTimeout)
+	defer cancel()
+
+	for i := len(r.actions) - 1; i >= 0; i-- {
+		action := r.actions[i]
+		fmt.Printf("Cleaning up: %s\n", action.description)
+		if err := action.undo(ctx); err != nil {
+			fmt.Printf("Warning: failed to %s: %v\n", action.description, err)
+		}
+	}
+	r.actions = nil
+}
@@ -0,0 +1,68 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestRollbackUnwind(t *testing.T) {
+	var order []string
+	rb := &rollback{}
+	for _, name := range []string{"secret", "pod", "port-forward"} {
+		name := name
+		rb.add(name, func(ctx context.Context) error {
+			if ctx.Err() != nil {
+				t.Errorf("Undo of %s ran with a cancelled context", name)
+			}
+			order = append(order, name)
+			if name == "pod" {
+				return errors.New("boom")
+			}
+			return nil
+		})
+	}
+
+	// The mount's context is typically cancelled by the signal that got us here
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rb.unwind(ctx)
+
+	want := []string{"port-forward", "pod", "secret"}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("Expected undo order %v, got %v", want, order)
+	}
+
+	// Unwinding twice doesn't repeat anything
+	rb.unwind(ctx)
+	if len(order) != len(want) {
+		t.Errorf("Expected no further undo actions, got %v", order)
+	}
+}
+
+func TestRollbackDeletesPod(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "volume-exposer-abcde", Namespace: "default"},
+	})
+
+	rb := &rollback{}
+	rb.add("delete pod volume-exposer-abcde", func(ctx context.Context) error {
+		return deletePod(ctx, clientset, "default", "volume-exposer-abcde", io.Discard)
+	})
+	rb.unwind(ctx)
+
+	pods, err := clientset.CoreV1().Pods("default").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("Failed to list pods: %v", err)
+	}
+	if len(pods.Items) != 0 {
+		t.Errorf("Expected the pod to be deleted, found %d pods", len(pods.Items))
+	}
+}
@@ -0,0 +1,77 @@
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+)
+
+// MountDirEnv tells the command started by Run where the volume is mounted.
+const MountDirEnv = "PV_MOUNT"
+
+// Run mounts the PVC into a temporary directory, runs command there and
+// cleans up once it exits. It returns the command's exit code; the error is
+// about the mount or the cleanup, not about the command.
+func Run(ctx context.Context, configFlags *genericclioptions.ConfigFlags, namespace, pvcName string, command []string, opts MountOptions) (int, error) {
+	if len(command) == 0 {
+		return 0, fmt.Errorf("no command given")
+	}
+
+	mountPoint, err := os.MkdirTemp("", "pv-mounter-run-")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temporary mount point: %v", err)
+	}
+	defer os.Remove(mountPoint)
+
+	// The session lives only as long as the command, leave nothing behind
+	opts.Foreground = false
+	opts.KeepOnFailure = false
+	if err := Mount(ctx, configFlags, namespace, pvcName, mountPoint, opts); err != nil {
+		return 0, err
+	}
+
+	code, runErr := runInMountPoint(mountPoint, command)
+
+	// The command may well have been stopped by the same Ctrl-C that
+	// cancelled ctx, clean up regardless
+	if err := Clean(context.WithoutCancel(ctx), configFlags, namespace, pvcName, mountPoint); err != nil {
+		return code, fmt.Errorf("failed to clean up %s: %v", mountPoint, err)
+	}
+	return code, runErr
+}
+
+// runInMountPoint runs command with mountPoint as its working directory and
+// in MountDirEnv. Signals from the terminal reach it directly, so it's left
+// to exit on its own.
+func runInMountPoint(mountPoint string, command []string) (int, error) {
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Dir = mountPoint
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%s", MountDirEnv, mountPoint))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitCode(exitErr.ProcessState), nil
+	}
+	if err != nil {
+		return 127, fmt.Errorf("failed to run %s: %v", command[0], err)
+	}
+	return 0, nil
+}
+
+// exitCode follows the shell convention of 128 + signal for a command that
+// was killed.
+func exitCode(state *os.ProcessState) int {
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
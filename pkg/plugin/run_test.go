@@ -0,0 +1,38 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunInMountPoint(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "data"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("Failed to write test file: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		command []string
+		want    int
+		wantErr bool
+	}{
+		{"runs in the mount point", []string{"sh", "-c", `test -f data && test "$PV_MOUNT" = "$PWD"`}, 0, false},
+		{"passes the exit code through", []string{"sh", "-c", "exit 3"}, 3, false},
+		{"reports a killed command like a shell", []string{"sh", "-c", "kill -TERM $$"}, 143, false},
+		{"fails on a missing command", []string{"pv-mounter-no-such-command"}, 127, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := runInMountPoint(dir, tt.command)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("runInMountPoint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if code != tt.want {
+				t.Errorf("Expected exit code %d, got %d", tt.want, code)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Keys of the per-session Secret. The pods only reference them, so the key
+// material never shows up in a pod spec.
+const (
+	PublicKeySecretKey     = "ssh-public-key"
+	PrivateKeySecretKey    = "ssh-private-key"
+	HostKeySecretKey       = "ssh-host-key"
+	HostPublicKeySecretKey = "ssh-host-public-key"
+)
+
+// sessionKeys are generated from scratch for every mount: the client key
+// pair sshfs logs in with, and the host key pair of the pods' sshd.
+type sessionKeys struct {
+	privateKey    string
+	publicKey     string
+	hostKey       string
+	hostPublicKey string
+}
+
+func generateSessionKeys(keyType KeyType) (*sessionKeys, error) {
+	privateKey, publicKey, err := GenerateKeyPair(keyType)
+	if err != nil {
+		return nil, fmt.Errorf("error generating key pair: %v", err)
+	}
+	hostKey, hostPublicKey, err := GenerateKeyPair(keyType)
+	if err != nil {
+		return nil, fmt.Errorf("error generating host key: %v", err)
+	}
+	return &sessionKeys{
+		privateKey:    privateKey,
+		publicKey:     publicKey,
+		hostKey:       hostKey,
+		hostPublicKey: hostPublicKey,
+	}, nil
+}
+
+func sessionSecretName(mountID string) string {
+	return fmt.Sprintf("volume-exposer-%s", mountID)
+}
+
+// createSessionSecret stores the keys of the session in a Secret. The client
+// private key is only needed by the ephemeral container, so it's left out
+// unless withPrivateKey is set.
+func createSessionSecret(ctx context.Context, clientset kubernetes.Interface, state *MountState, keys *sessionKeys, withPrivateKey bool) (string, error) {
+	immutable := true
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: sessionSecretName(state.ID),
+			Labels: map[string]string{
+				"app":        "volume-exposer",
+				"pvcName":    state.PVCName,
+				MountIDLabel: state.ID,
+			},
+		},
+		Type:      corev1.SecretTypeOpaque,
+		Immutable: &immutable,
+		StringData: map[string]string{
+			PublicKeySecretKey:     keys.publicKey,
+			HostKeySecretKey:       keys.hostKey,
+			HostPublicKeySecretKey: keys.hostPublicKey,
+		},
+	}
+	if withPrivateKey {
+		secret.StringData[PrivateKeySecretKey] = keys.privateKey
+	}
+
+	if _, err := clientset.CoreV1().Secrets(state.Namespace).Create(ctx, secret, metav1.CreateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to create secret: %v", err)
+	}
+	fmt.Printf("Secret %s created successfully\n", secret.Name)
+	return secret.Name, nil
+}
+
+// setSecretOwner makes the pod own the Secret, so the keys are garbage
+// collected together with the pod even if clean never runs.
+func setSecretOwner(ctx context.Context, clientset kubernetes.Interface, namespace, secretName string, pod *corev1.Pod) error {
+	patchData, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"ownerReferences": []metav1.OwnerReference{
+				{
+					APIVersion: "v1",
+					Kind:       "Pod",
+					Name:       pod.Name,
+					UID:        pod.UID,
+				},
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal owner patch: %v", err)
+	}
+	_, err = clientset.CoreV1().Secrets(namespace).Patch(ctx, secretName, types.MergePatchType, patchData, metav1.PatchOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to set owner of secret %s: %v", secretName, err)
+	}
+	return nil
+}
+
+func deleteSessionSecret(ctx context.Context, clientset kubernetes.Interface, namespace, mountID string, out io.Writer) error {
+	if mountID == "" {
+		return nil
+	}
+	secretName := sessionSecretName(mountID)
+	err := clientset.CoreV1().Secrets(namespace).Delete(ctx, secretName, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete secret: %v", err)
+	}
+	fmt.Fprintf(out, "Secret %s deleted successfully\n", secretName)
+	return nil
+}
+
+func secretEnvVar(name, secretName, key string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+				Key:                  key,
+			},
+		},
+	}
+}
@@ -0,0 +1,74 @@
+package plugin
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSessionSecretLifecycle(t *testing.T) {
+	ctx := context.Background()
+	clientset := fake.NewSimpleClientset()
+	state := &MountState{ID: "abcdefgh", Namespace: "default", PVCName: "data"}
+
+	secretName, err := createSessionSecret(ctx, clientset, state, &sessionKeys{publicKey: "publicKey", hostKey: "hostKey", hostPublicKey: "hostPublicKey"}, false)
+	if err != nil {
+		t.Fatalf("createSessionSecret() returned error: %v", err)
+	}
+	if secretName != "volume-exposer-abcdefgh" {
+		t.Errorf("Unexpected secret name %s", secretName)
+	}
+	secret, err := clientset.CoreV1().Secrets("default").Get(ctx, secretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get secret: %v", err)
+	}
+	if _, ok := secret.StringData[PrivateKeySecretKey]; ok {
+		t.Error("Expected no private key in the secret of a standalone session")
+	}
+	if secret.Labels[MountIDLabel] != "abcdefgh" {
+		t.Errorf("Expected the secret to carry the mount ID, got %v", secret.Labels)
+	}
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "volume-exposer-abcde", UID: types.UID("1234")}}
+	if err := setSecretOwner(ctx, clientset, "default", secretName, pod); err != nil {
+		t.Fatalf("setSecretOwner() returned error: %v", err)
+	}
+	secret, err = clientset.CoreV1().Secrets("default").Get(ctx, secretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get secret: %v", err)
+	}
+	if len(secret.OwnerReferences) != 1 || secret.OwnerReferences[0].UID != "1234" {
+		t.Errorf("Expected the pod to own the secret, got %+v", secret.OwnerReferences)
+	}
+
+	if err := deleteSessionSecret(ctx, clientset, "default", state.ID, io.Discard); err != nil {
+		t.Fatalf("deleteSessionSecret() returned error: %v", err)
+	}
+	// A second delete finds nothing and still succeeds
+	if err := deleteSessionSecret(ctx, clientset, "default", state.ID, io.Discard); err != nil {
+		t.Errorf("deleteSessionSecret() of a missing secret returned error: %v", err)
+	}
+}
+
+func TestPodSpecsKeepKeysOutOfEnv(t *testing.T) {
+	pod := createPodSpec("test-pod", "test-pvc", "volume-exposer-abcdefgh", "standalone", 22, "", "", "", false, false)
+	container := createEphemeralContainerSpec("volume-exposer-ephemeral-abcde", "data", "volume-exposer-abcdefgh", "10.0.0.1", nil, false, false)
+
+	envs := append(pod.Spec.Containers[0].Env, container.Env...)
+	for _, env := range envs {
+		if env.Name != "SSH_PUBLIC_KEY" && env.Name != "SSH_PRIVATE_KEY" {
+			continue
+		}
+		if env.Value != "" {
+			t.Errorf("Expected %s to come from the secret, got a literal value", env.Name)
+		}
+		if env.ValueFrom == nil || env.ValueFrom.SecretKeyRef == nil || env.ValueFrom.SecretKeyRef.Name != "volume-exposer-abcdefgh" {
+			t.Errorf("Expected %s to reference the session secret, got %+v", env.Name, env.ValueFrom)
+		}
+	}
+}
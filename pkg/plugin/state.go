@@ -0,0 +1,208 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MountState is the local record of a single mount, written by Mount and
+// read back by list, status and clean.
+type MountState struct {
+	ID                 string    `json:"id"`
+	Context            string    `json:"context"`
+	Namespace          string    `json:"namespace"`
+	PVCName            string    `json:"pvcName"`
+	Volume             string    `json:"volume,omitempty"`
+	SubPath            string    `json:"subPath,omitempty"`
+	PodName            string    `json:"podName"`
+	TargetPodName      string    `json:"targetPodName,omitempty"`
+	EphemeralContainer string    `json:"ephemeralContainer,omitempty"`
+	LocalPort          int       `json:"localPort"`
+	PortForwardPID     int       `json:"portForwardPID"`
+	SSHFSPID           int       `json:"sshfsPID,omitempty"`
+	MountPoint         string    `json:"mountPoint"`
+	CreatedAt          time.Time `json:"createdAt"`
+}
+
+// source says what the session mounts, at the start of a message.
+func (s *MountState) source() string {
+	if s.PVCName != "" {
+		return "PVC " + s.PVCName
+	}
+	return fmt.Sprintf("Volume %s of pod %s", s.Volume, s.TargetPodName)
+}
+
+// target is what the session mounts in the form the mount command takes.
+func (s *MountState) target() string {
+	if s.PVCName != "" {
+		return s.PVCName
+	}
+	return fmt.Sprintf("%s%s:%s", PodPrefix, s.TargetPodName, s.Volume)
+}
+
+// stateDir returns $XDG_STATE_HOME/pv-mounter, defaulting to
+// ~/.local/state/pv-mounter.
+func stateDir() (string, error) {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "pv-mounter"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine state directory: %v", err)
+	}
+	return filepath.Join(home, ".local", "state", "pv-mounter"), nil
+}
+
+func stateFile(dir, id string) string {
+	return filepath.Join(dir, id+".json")
+}
+
+func knownHostsFile(dir, id string) string {
+	return filepath.Join(dir, id+".known_hosts")
+}
+
+// hostKeyAlias is the name the session host key is pinned under, as sshfs
+// only ever sees localhost and a random port.
+func hostKeyAlias(id string) string {
+	return fmt.Sprintf("volume-exposer-%s", id)
+}
+
+// writeKnownHosts records the session host key for sshfs and returns the path
+// of the file.
+func writeKnownHosts(id, alias, hostPublicKey string) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create state directory: %v", err)
+	}
+	path := knownHostsFile(dir, id)
+	line := fmt.Sprintf("%s %s\n", alias, strings.TrimSpace(hostPublicKey))
+	if err := os.WriteFile(path, []byte(line), 0600); err != nil {
+		return "", fmt.Errorf("failed to write known hosts file: %v", err)
+	}
+	return path, nil
+}
+
+// absMountPoint normalizes a mount point so records can be matched no matter
+// how the path was spelled on the command line.
+func absMountPoint(localMountPoint string) (string, error) {
+	path, err := filepath.Abs(localMountPoint)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve mount point %s: %v", localMountPoint, err)
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	return path, nil
+}
+
+func saveMountState(state *MountState) error {
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal mount state: %v", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a torn record
+	tmpFile, err := os.CreateTemp(dir, state.ID+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create state file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to close state file: %v", err)
+	}
+	if err := os.Rename(tmpFile.Name(), stateFile(dir, state.ID)); err != nil {
+		return fmt.Errorf("failed to save state file: %v", err)
+	}
+	return nil
+}
+
+// loadMountStates returns all recorded mounts, oldest first.
+func loadMountStates() ([]*MountState, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state directory: %v", err)
+	}
+
+	var states []*MountState
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read state file %s: %v", entry.Name(), err)
+		}
+		var state MountState
+		if err := json.Unmarshal(data, &state); err != nil {
+			fmt.Printf("Ignoring corrupt state file %s: %v\n", entry.Name(), err)
+			continue
+		}
+		states = append(states, &state)
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].CreatedAt.Before(states[j].CreatedAt)
+	})
+	return states, nil
+}
+
+// findMountState returns the record for the given mount point, or nil if
+// pv-mounter doesn't know about it.
+func findMountState(localMountPoint string) (*MountState, error) {
+	mountPoint, err := absMountPoint(localMountPoint)
+	if err != nil {
+		return nil, err
+	}
+	states, err := loadMountStates()
+	if err != nil {
+		return nil, err
+	}
+	for _, state := range states {
+		if state.MountPoint == mountPoint {
+			return state, nil
+		}
+	}
+	return nil, nil
+}
+
+func removeMountState(id string) error {
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(stateFile(dir, id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove state file: %v", err)
+	}
+	if err := os.Remove(knownHostsFile(dir, id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove known hosts file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStateDir(t *testing.T) {
+	t.Run("XDG_STATE_HOME set", func(t *testing.T) {
+		t.Setenv("XDG_STATE_HOME", "/tmp/state")
+		dir, err := stateDir()
+		if err != nil {
+			t.Fatalf("stateDir returned an error: %v", err)
+		}
+		if dir != "/tmp/state/pv-mounter" {
+			t.Errorf("Expected /tmp/state/pv-mounter, got %s", dir)
+		}
+	})
+
+	t.Run("XDG_STATE_HOME unset", func(t *testing.T) {
+		t.Setenv("XDG_STATE_HOME", "")
+		t.Setenv("HOME", "/home/ve")
+		dir, err := stateDir()
+		if err != nil {
+			t.Fatalf("stateDir returned an error: %v", err)
+		}
+		if dir != "/home/ve/.local/state/pv-mounter" {
+			t.Errorf("Expected /home/ve/.local/state/pv-mounter, got %s", dir)
+		}
+	})
+}
+
+func TestMountStateLifecycle(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	mountPoint := t.TempDir()
+
+	states, err := loadMountStates()
+	if err != nil {
+		t.Fatalf("loadMountStates returned an error: %v", err)
+	}
+	if len(states) != 0 {
+		t.Fatalf("Expected no states, got %d", len(states))
+	}
+
+	older := &MountState{ID: "older", PVCName: "pvc-1", MountPoint: "/elsewhere", CreatedAt: time.Now().Add(-time.Hour)}
+	newer := &MountState{ID: "newer", PVCName: "pvc-2", MountPoint: mountPoint, LocalPort: 40000, CreatedAt: time.Now()}
+	for _, state := range []*MountState{newer, older} {
+		if err := saveMountState(state); err != nil {
+			t.Fatalf("saveMountState returned an error: %v", err)
+		}
+	}
+
+	dir, _ := stateDir()
+	info, err := os.Stat(stateFile(dir, "newer"))
+	if err != nil {
+		t.Fatalf("State file missing: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected state file mode 0600, got %v", info.Mode().Perm())
+	}
+
+	states, err = loadMountStates()
+	if err != nil {
+		t.Fatalf("loadMountStates returned an error: %v", err)
+	}
+	if len(states) != 2 || states[0].ID != "older" || states[1].ID != "newer" {
+		t.Fatalf("Expected states ordered by creation time, got %+v", states)
+	}
+
+	// Relative spellings of the same directory must find the record
+	relative, err := filepath.Rel(mustGetwd(t), mountPoint)
+	if err != nil {
+		t.Fatalf("Failed to build relative path: %v", err)
+	}
+	found, err := findMountState(relative)
+	if err != nil {
+		t.Fatalf("findMountState returned an error: %v", err)
+	}
+	if found == nil || found.ID != "newer" || found.LocalPort != 40000 {
+		t.Fatalf("Expected to find state newer, got %+v", found)
+	}
+
+	if err := removeMountState("newer"); err != nil {
+		t.Fatalf("removeMountState returned an error: %v", err)
+	}
+	if err := removeMountState("newer"); err != nil {
+		t.Errorf("Removing a missing state should not fail: %v", err)
+	}
+	found, err = findMountState(mountPoint)
+	if err != nil {
+		t.Fatalf("findMountState returned an error: %v", err)
+	}
+	if found != nil {
+		t.Errorf("Expected state to be gone, got %+v", found)
+	}
+}
+
+func TestMountTableContains(t *testing.T) {
+	table := strings.Join([]string{
+		"proc /proc proc rw,nosuid,nodev,noexec,relatime 0 0",
+		"ve@localhost:/volume /home/me/pvc fuse.sshfs rw,nosuid,nodev,relatime 0 0",
+		`ve@localhost:/volume /home/me/my\040data fuse.sshfs rw,nosuid,nodev,relatime 0 0`,
+	}, "\n")
+
+	for mountPoint, want := range map[string]bool{
+		"/home/me/pvc":     true,
+		"/home/me/my data": true,
+		"/home/me/other":   false,
+	} {
+		got, err := mountTableContains(strings.NewReader(table), mountPoint)
+		if err != nil {
+			t.Fatalf("mountTableContains returned an error: %v", err)
+		}
+		if got != want {
+			t.Errorf("mountTableContains(%q) = %v; want %v", mountPoint, got, want)
+		}
+	}
+}
+
+func TestProcessAlive(t *testing.T) {
+	if !processAlive(os.Getpid()) {
+		t.Error("Expected the test process to be alive")
+	}
+	if processAlive(0) {
+		t.Error("PID 0 should never be reported alive")
+	}
+}
+
+func mustGetwd(t *testing.T) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Failed to get working directory: %v", err)
+	}
+	return wd
+}
+
+func TestKnownHostsLifecycle(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	path, err := writeKnownHosts("abcdefgh", hostKeyAlias("abcdefgh"), "ecdsa-sha2-nistp256 AAAA\n")
+	if err != nil {
+		t.Fatalf("writeKnownHosts returned an error: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Known hosts file missing: %v", err)
+	}
+	if string(data) != "volume-exposer-abcdefgh ecdsa-sha2-nistp256 AAAA\n" {
+		t.Errorf("Unexpected known hosts content %q", data)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Known hosts file missing: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	if err := removeMountState("abcdefgh"); err != nil {
+		t.Fatalf("removeMountState returned an error: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the known hosts file to be removed, got %v", err)
+	}
+}
+
+func TestMountStateTarget(t *testing.T) {
+	pvc := &MountState{PVCName: "data-web-0", Volume: "data", TargetPodName: "web-0"}
+	if got := pvc.target(); got != "data-web-0" {
+		t.Errorf("Expected the PVC as target, got %q", got)
+	}
+	volume := &MountState{Volume: "cache", TargetPodName: "web-0"}
+	if got := volume.target(); got != "pod/web-0:cache" {
+		t.Errorf("Expected the pod volume as target, got %q", got)
+	}
+	if got := volume.source(); got != "Volume cache of pod web-0" {
+		t.Errorf("Unexpected source %q", got)
+	}
+}
@@ -0,0 +1,277 @@
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
+	"k8s.io/client-go/kubernetes"
+)
+
+// mountHealth is the result of checking a recorded mount against the
+// cluster and the local machine.
+type mountHealth struct {
+	Mounted          bool
+	PortForwardAlive bool
+	PodStatus        string
+	ContainerStatus  string
+	Problems         []string
+}
+
+func (h mountHealth) healthy() bool {
+	return len(h.Problems) == 0
+}
+
+func (h mountHealth) summary() string {
+	if h.healthy() {
+		return "Healthy"
+	}
+	return "Degraded: " + strings.Join(h.Problems, ", ")
+}
+
+// List prints all mounts recorded on this machine together with their health.
+func List(ctx context.Context, configFlags *genericclioptions.ConfigFlags, out io.Writer) error {
+	states, err := loadMountStates()
+	if err != nil {
+		return err
+	}
+	if len(states) == 0 {
+		fmt.Fprintln(out, "No mounts found")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "ID\tCONTEXT\tNAMESPACE\tPVC\tMOUNTPOINT\tPORT\tAGE\tSTATUS")
+	for _, state := range states {
+		health := checkMountHealth(ctx, configFlags, state)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			state.ID, state.Context, state.Namespace, state.target(), state.MountPoint,
+			state.LocalPort, duration.HumanDuration(time.Since(state.CreatedAt)), health.summary())
+	}
+	return w.Flush()
+}
+
+// Status prints the details and health of the mount at localMountPoint.
+func Status(ctx context.Context, configFlags *genericclioptions.ConfigFlags, localMountPoint string, out io.Writer) error {
+	state, err := findMountState(localMountPoint)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return fmt.Errorf("no pv-mounter mount recorded for %s", localMountPoint)
+	}
+
+	health := checkMountHealth(ctx, configFlags, state)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Mount ID:\t%s\n", state.ID)
+	fmt.Fprintf(w, "Mount point:\t%s\n", state.MountPoint)
+	fmt.Fprintf(w, "Context:\t%s\n", state.Context)
+	fmt.Fprintf(w, "Namespace:\t%s\n", state.Namespace)
+	if state.PVCName != "" {
+		fmt.Fprintf(w, "PVC:\t%s\n", state.PVCName)
+	}
+	if state.Volume != "" {
+		fmt.Fprintf(w, "Volume:\t%s\n", state.Volume)
+	}
+	if state.SubPath != "" {
+		fmt.Fprintf(w, "Sub-path:\t%s\n", state.SubPath)
+	}
+	fmt.Fprintf(w, "Pod:\t%s (%s)\n", state.PodName, health.PodStatus)
+	if state.TargetPodName != "" {
+		fmt.Fprintf(w, "Target pod:\t%s\n", state.TargetPodName)
+		fmt.Fprintf(w, "Ephemeral container:\t%s (%s)\n", state.EphemeralContainer, health.ContainerStatus)
+	}
+	fmt.Fprintf(w, "Local port:\t%d\n", state.LocalPort)
+	fmt.Fprintf(w, "Port-forward PID:\t%d (%s)\n", state.PortForwardPID, aliveString(health.PortForwardAlive))
+	if state.SSHFSPID != 0 {
+		fmt.Fprintf(w, "SSHFS PID:\t%d (%s)\n", state.SSHFSPID, aliveString(processAlive(state.SSHFSPID)))
+	}
+	fmt.Fprintf(w, "Mounted:\t%v\n", health.Mounted)
+	fmt.Fprintf(w, "Created:\t%s (%s ago)\n", state.CreatedAt.Format(time.RFC3339), duration.HumanDuration(time.Since(state.CreatedAt)))
+	fmt.Fprintf(w, "Status:\t%s\n", health.summary())
+	return w.Flush()
+}
+
+func aliveString(alive bool) string {
+	if alive {
+		return "running"
+	}
+	return "not running"
+}
+
+func checkMountHealth(ctx context.Context, configFlags *genericclioptions.ConfigFlags, state *MountState) mountHealth {
+	health := mountHealth{
+		PodStatus:       "unknown",
+		ContainerStatus: "unknown",
+	}
+
+	mounted, err := isMounted(state.MountPoint)
+	switch {
+	case err != nil:
+		health.Problems = append(health.Problems, fmt.Sprintf("mount table unreadable: %v", err))
+	case !mounted:
+		health.Problems = append(health.Problems, "not mounted")
+	}
+	health.Mounted = mounted
+
+	health.PortForwardAlive = processAlive(state.PortForwardPID) && isPortForwarder(state.PortForwardPID, state)
+	if !health.PortForwardAlive {
+		health.Problems = append(health.Problems, "port-forward not running")
+	}
+
+	clientset, _, err := BuildKubeClient(configFlagsForContext(configFlags, state.Context))
+	if err != nil {
+		health.Problems = append(health.Problems, "cluster unreachable")
+		return health
+	}
+
+	health.PodStatus = podHealth(ctx, clientset, state.Namespace, state.PodName)
+	if health.PodStatus != "Ready" {
+		health.Problems = append(health.Problems, fmt.Sprintf("pod %s", strings.ToLower(health.PodStatus)))
+	}
+
+	if state.TargetPodName != "" {
+		health.ContainerStatus = ephemeralContainerHealth(ctx, clientset, state.Namespace, state.TargetPodName, state.EphemeralContainer)
+		if health.ContainerStatus != "Running" {
+			health.Problems = append(health.Problems, fmt.Sprintf("ephemeral container %s", strings.ToLower(health.ContainerStatus)))
+		}
+	}
+	return health
+}
+
+func podHealth(ctx context.Context, clientset kubernetes.Interface, namespace, podName string) string {
+	pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "Missing"
+	}
+	if err != nil {
+		return "Unknown"
+	}
+	for _, cond := range pod.Status.Conditions {
+		if cond.Type == corev1.PodReady && cond.Status == corev1.ConditionTrue {
+			return "Ready"
+		}
+	}
+	return string(pod.Status.Phase)
+}
+
+func ephemeralContainerHealth(ctx context.Context, clientset kubernetes.Interface, namespace, podName, containerName string) string {
+	pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return "Missing"
+	}
+	if err != nil {
+		return "Unknown"
+	}
+	for _, status := range pod.Status.EphemeralContainerStatuses {
+		if status.Name != containerName {
+			continue
+		}
+		switch {
+		case status.State.Running != nil:
+			return "Running"
+		case status.State.Waiting != nil:
+			return "Waiting"
+		case status.State.Terminated != nil:
+			return "Terminated"
+		}
+	}
+	return "Missing"
+}
+
+// configFlagsForContext returns a copy of configFlags pointing at
+// kubeContext, so a recorded mount is always checked against the cluster it
+// was made in.
+func configFlagsForContext(configFlags *genericclioptions.ConfigFlags, kubeContext string) *genericclioptions.ConfigFlags {
+	flags := kubeFlagsFrom(configFlags)
+	if kubeContext != "" {
+		flags.Context = kubeContext
+	}
+	return flags.toConfigFlags()
+}
+
+// processAlive reports whether a process with the given PID exists.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// isMounted reports whether localMountPoint is currently a mount point.
+func isMounted(localMountPoint string) (bool, error) {
+	if runtime.GOOS == "linux" {
+		f, err := os.Open("/proc/mounts")
+		if err != nil {
+			return false, err
+		}
+		defer f.Close()
+		return mountTableContains(f, localMountPoint)
+	}
+
+	output, err := exec.Command("mount").Output()
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		// macOS prints "<source> on <mount point> (<options>)"
+		if _, rest, ok := strings.Cut(line, " on "); ok {
+			if idx := strings.LastIndex(rest, " ("); idx >= 0 && rest[:idx] == localMountPoint {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// mountTableContains scans a /proc/mounts formatted table for mountPoint.
+func mountTableContains(r io.Reader, mountPoint string) (bool, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		if unescapeMountField(fields[1]) == mountPoint {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// unescapeMountField decodes the octal escapes (\040 for space and friends)
+// used by the kernel in /proc/mounts.
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+4 <= len(field) {
+			if v, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
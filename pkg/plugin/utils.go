@@ -1,86 +1,80 @@
 package plugin
 
 import (
-	crand "crypto/rand"
-	"crypto/x509"
-	"encoding/pem"
-
-	"crypto/ecdsa"
-	"crypto/elliptic"
-
 	"fmt"
-	"golang.org/x/crypto/ssh"
+	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/rest"
 	"math/rand"
 	"os"
 	"os/exec"
+	"regexp"
 	"runtime"
+	"strconv"
 	"strings"
 )
 
-func BuildKubeClient() (*kubernetes.Clientset, error) {
-	kubeconfig := os.Getenv("KUBECONFIG")
-	if kubeconfig == "" {
-		home := os.Getenv("HOME")
-		kubeconfig = fmt.Sprintf("%s/.kube/config", home)
-	}
-
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+// BuildKubeClient creates a clientset from the global kubeconfig flags, so
+// --kubeconfig, --context, --as, --token and friends (including exec auth
+// plugins) are honored the same way kubectl honors them.
+func BuildKubeClient(configFlags genericclioptions.RESTClientGetter) (*kubernetes.Clientset, *rest.Config, error) {
+	config, err := configFlags.ToRESTConfig()
 	if err != nil {
-		return nil, fmt.Errorf("failed to build Kubernetes config: %v", err)
+		return nil, nil, fmt.Errorf("failed to build Kubernetes config: %v", err)
 	}
 
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create Kubernetes client: %v", err)
+		return nil, nil, fmt.Errorf("failed to create Kubernetes client: %v", err)
 	}
 
-	return clientset, nil
+	return clientset, config, nil
 }
 
-func randSeq(n int) string {
-	letters := []rune("abcdefghijklmnopqrstuvwxyz0123456789")
-	b := make([]rune, n)
-	for i := range b {
-		b[i] = letters[rand.Intn(len(letters))]
+// ResolveNamespace returns the namespace selected by --namespace or, when the
+// flag is not set, the namespace of the active kubeconfig context.
+func ResolveNamespace(configFlags genericclioptions.RESTClientGetter) (string, error) {
+	namespace, _, err := configFlags.ToRawKubeConfigLoader().Namespace()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine namespace: %v", err)
 	}
-	return string(b)
+	return namespace, nil
 }
 
-func GenerateKeyPair(curve elliptic.Curve) (string, string, error) {
-	// Generate a new private key
-	privateKey, err := ecdsa.GenerateKey(curve, crand.Reader)
+// currentContext returns the kubeconfig context in effect, taking --context
+// into account.
+func currentContext(configFlags *genericclioptions.ConfigFlags) (string, error) {
+	if configFlags.Context != nil && *configFlags.Context != "" {
+		return *configFlags.Context, nil
+	}
+	rawConfig, err := configFlags.ToRawKubeConfigLoader().RawConfig()
 	if err != nil {
-		return "", "", fmt.Errorf("failed to generate private key: %v", err)
+		return "", fmt.Errorf("failed to load kubeconfig: %v", err)
 	}
+	return rawConfig.CurrentContext, nil
+}
 
-	// Encode the private key to PKCS8 format
-	privateKeyPKCS8, err := x509.MarshalECPrivateKey(privateKey)
+// findSSHFSPID returns the PID of the sshfs daemon serving localMountPoint,
+// or 0 if it can't be determined.
+func findSSHFSPID(localMountPoint string) int {
+	output, err := exec.Command("pgrep", "-n", "-f", fmt.Sprintf("sshfs .* %s", regexp.QuoteMeta(localMountPoint))).Output()
 	if err != nil {
-		return "", "", fmt.Errorf("failed to marshal private key to PKCS8: %v", err)
+		return 0
 	}
-
-	// Encode the private key to PEM format
-	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "EC PRIVATE KEY",
-		Bytes: privateKeyPKCS8,
-	})
-
-	// Extract the public key from the private key
-	publicKey := &privateKey.PublicKey
-
-	// Convert the ECDSA public key to the ssh.PublicKey type
-	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(output)))
 	if err != nil {
-		return "", "", fmt.Errorf("failed to create SSH public key: %v", err)
+		return 0
 	}
+	return pid
+}
 
-	// Encode the SSH public key to the authorized_keys format
-	publicKeyBytes := ssh.MarshalAuthorizedKey(sshPublicKey)
-	trimmedPublicKey := strings.TrimSpace(string(publicKeyBytes))
-
-	return string(privateKeyPEM), trimmedPublicKey, nil
+func randSeq(n int) string {
+	letters := []rune("abcdefghijklmnopqrstuvwxyz0123456789")
+	b := make([]rune, n)
+	for i := range b {
+		b[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(b)
 }
 
 func checkSSHFS() {
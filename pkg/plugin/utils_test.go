@@ -2,11 +2,117 @@ package plugin
 
 import (
 	// Necessary imports
-	"crypto/elliptic"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+
+	"k8s.io/cli-runtime/pkg/genericclioptions"
 )
 
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: dev
+  cluster:
+    server: https://dev.example.com
+- name: prod
+  cluster:
+    server: https://prod.example.com
+users:
+- name: me
+  user:
+    token: secret
+contexts:
+- name: dev
+  context:
+    cluster: dev
+    user: me
+    namespace: team-a
+- name: prod
+  context:
+    cluster: prod
+    user: me
+current-context: dev
+`
+
+func newTestConfigFlags(t *testing.T) *genericclioptions.ConfigFlags {
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(testKubeconfig), 0600); err != nil {
+		t.Fatalf("Failed to write kubeconfig: %v", err)
+	}
+	configFlags := genericclioptions.NewConfigFlags(false)
+	configFlags.KubeConfig = &path
+	return configFlags
+}
+
+func TestBuildKubeClient(t *testing.T) {
+	t.Run("Current context", func(t *testing.T) {
+		_, config, err := BuildKubeClient(newTestConfigFlags(t))
+		if err != nil {
+			t.Fatalf("BuildKubeClient returned an error: %v", err)
+		}
+		if config.Host != "https://dev.example.com" {
+			t.Errorf("Expected dev server, got %s", config.Host)
+		}
+	})
+
+	t.Run("Context and impersonation flags", func(t *testing.T) {
+		configFlags := newTestConfigFlags(t)
+		kubeContext, impersonate := "prod", "jane"
+		configFlags.Context = &kubeContext
+		configFlags.Impersonate = &impersonate
+		_, config, err := BuildKubeClient(configFlags)
+		if err != nil {
+			t.Fatalf("BuildKubeClient returned an error: %v", err)
+		}
+		if config.Host != "https://prod.example.com" {
+			t.Errorf("Expected prod server, got %s", config.Host)
+		}
+		if config.Impersonate.UserName != "jane" {
+			t.Errorf("Expected impersonated user jane, got %q", config.Impersonate.UserName)
+		}
+	})
+}
+
+func TestResolveNamespace(t *testing.T) {
+	t.Run("From context", func(t *testing.T) {
+		namespace, err := ResolveNamespace(newTestConfigFlags(t))
+		if err != nil {
+			t.Fatalf("ResolveNamespace returned an error: %v", err)
+		}
+		if namespace != "team-a" {
+			t.Errorf("Expected namespace team-a, got %s", namespace)
+		}
+	})
+
+	t.Run("Context without namespace", func(t *testing.T) {
+		configFlags := newTestConfigFlags(t)
+		kubeContext := "prod"
+		configFlags.Context = &kubeContext
+		namespace, err := ResolveNamespace(configFlags)
+		if err != nil {
+			t.Fatalf("ResolveNamespace returned an error: %v", err)
+		}
+		if namespace != "default" {
+			t.Errorf("Expected namespace default, got %s", namespace)
+		}
+	})
+
+	t.Run("Namespace flag", func(t *testing.T) {
+		configFlags := newTestConfigFlags(t)
+		flagNamespace := "team-b"
+		configFlags.Namespace = &flagNamespace
+		namespace, err := ResolveNamespace(configFlags)
+		if err != nil {
+			t.Fatalf("ResolveNamespace returned an error: %v", err)
+		}
+		if namespace != "team-b" {
+			t.Errorf("Expected namespace team-b, got %s", namespace)
+		}
+	})
+}
+
 func TestRandSeq(t *testing.T) {
 	length := 10
 	seq := randSeq(length)
@@ -20,14 +126,3 @@ func TestRandSeq(t *testing.T) {
 		}
 	}
 }
-
-func TestGenerateKeyPair(t *testing.T) {
-	privateKey, publicKey, err := GenerateKeyPair(elliptic.P256())
-	if err != nil {
-		t.Fatalf("GenerateKeyPair returned an error: %v", err)
-	}
-	if privateKey == "" || publicKey == "" {
-		t.Error("GenerateKeyPair returned empty keys")
-	}
-	// Additional checks can be added to validate the key formats
-}
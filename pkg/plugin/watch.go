@@ -0,0 +1,144 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// podCheck looks at the latest pod and its Events, oldest first, and says
+// whether the wait is over.
+type podCheck func(pod *corev1.Pod, events []corev1.Event) (bool, error)
+
+// waitForPod calls check whenever the pod, or with withEvents its Events,
+// change, until check is done or fails, or ctx is done. Instead of polling,
+// it runs informers scoped to the pod by field selectors: they list once,
+// then watch from the listed resourceVersion and resume from the last one
+// they saw when the watch drops.
+func waitForPod(ctx context.Context, clientset kubernetes.Interface, namespace, podName string, withEvents bool, check podCheck) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { notify() },
+		UpdateFunc: func(interface{}, interface{}) { notify() },
+		DeleteFunc: func(interface{}) { notify() },
+	}
+
+	// Watch failures are retried by the informer, only missing permissions
+	// won't go away
+	fatal := make(chan error, 1)
+	pods := cache.NewSharedIndexInformer(podListWatch(ctx, clientset, namespace, podName), &corev1.Pod{}, 0, cache.Indexers{})
+	_ = pods.SetWatchErrorHandler(func(_ *cache.Reflector, err error) {
+		if apierrors.IsForbidden(err) || apierrors.IsUnauthorized(err) {
+			select {
+			case fatal <- fmt.Errorf("failed to watch pod %s: %v", podName, err):
+			default:
+			}
+		}
+	})
+	if _, err := pods.AddEventHandler(handler); err != nil {
+		return fmt.Errorf("failed to watch pod %s: %v", podName, err)
+	}
+	go pods.Run(ctx.Done())
+	go func() {
+		if cache.WaitForCacheSync(ctx.Done(), pods.HasSynced) {
+			notify()
+		}
+	}()
+
+	var events cache.Store
+	if withEvents && canListPodEvents(ctx, clientset, namespace, podName) {
+		// Events only add detail, they're never worth failing for
+		eventInformer := cache.NewSharedIndexInformer(podEventListWatch(ctx, clientset, namespace, podName), &corev1.Event{}, 0, cache.Indexers{})
+		_ = eventInformer.SetWatchErrorHandler(func(*cache.Reflector, error) {})
+		if _, err := eventInformer.AddEventHandler(handler); err == nil {
+			events = eventInformer.GetStore()
+			go eventInformer.Run(ctx.Done())
+		}
+	}
+
+	for {
+		if pods.HasSynced() {
+			obj, exists, err := pods.GetStore().GetByKey(namespace + "/" + podName)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("pod %s is gone", podName)
+			}
+			pod := obj.(*corev1.Pod)
+			done, err := check(pod, eventsOf(pod, events))
+			if done || err != nil {
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-fatal:
+			return err
+		case <-changed:
+		}
+	}
+}
+
+func podListWatch(ctx context.Context, clientset kubernetes.Interface, namespace, podName string) *cache.ListWatch {
+	selector := fields.OneTermEqualSelector("metadata.name", podName).String()
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return clientset.CoreV1().Pods(namespace).List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return clientset.CoreV1().Pods(namespace).Watch(ctx, options)
+		},
+	}
+}
+
+func podEventSelector(podName string) string {
+	return fields.AndSelectors(
+		fields.OneTermEqualSelector("involvedObject.kind", "Pod"),
+		fields.OneTermEqualSelector("involvedObject.name", podName),
+	).String()
+}
+
+func podEventListWatch(ctx context.Context, clientset kubernetes.Interface, namespace, podName string) *cache.ListWatch {
+	selector := podEventSelector(podName)
+	return &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = selector
+			return clientset.CoreV1().Events(namespace).List(ctx, options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = selector
+			return clientset.CoreV1().Events(namespace).Watch(ctx, options)
+		},
+	}
+}
+
+// canListPodEvents finds out up front whether Events can be read, so an
+// informer without permission doesn't keep warning about it.
+func canListPodEvents(ctx context.Context, clientset kubernetes.Interface, namespace, podName string) bool {
+	_, err := clientset.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: podEventSelector(podName),
+		Limit:         1,
+	})
+	return err == nil
+}
@@ -0,0 +1,62 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWaitForPodFollowsUpdates(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	pod := pendingExposerPod()
+	clientset := fake.NewSimpleClientset(pod)
+
+	result := make(chan error, 1)
+	go func() {
+		result <- waitForPodReady(ctx, clientset, "default", pod.Name, time.Minute)
+	}()
+
+	// The fake watch may start after an update, so keep updating until the
+	// wait notices
+	ready := pod.DeepCopy()
+	ready.Status.Phase = corev1.PodRunning
+	ready.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for i := 0; ; i++ {
+		select {
+		case err := <-result:
+			if err != nil {
+				t.Fatalf("Expected the pod to become ready, got %v", err)
+			}
+			return
+		case <-ticker.C:
+			ready.Annotations = map[string]string{"update": fmt.Sprint(i)}
+			if _, err := clientset.CoreV1().Pods("default").Update(ctx, ready, metav1.UpdateOptions{}); err != nil {
+				t.Fatalf("Failed to update the pod: %v", err)
+			}
+		case <-ctx.Done():
+			t.Fatal("The wait never noticed the pod became ready")
+		}
+	}
+}
+
+func TestWaitForPodGone(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err := waitForPod(ctx, fake.NewSimpleClientset(), "default", "missing", false, func(*corev1.Pod, []corev1.Event) (bool, error) {
+		return true, nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "is gone") {
+		t.Errorf("Expected a missing pod to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Workload kinds accepted in place of a PVC name, spelled like kubectl does.
+var workloadKinds = map[string]string{
+	"sts":         "StatefulSet",
+	"statefulset": "StatefulSet",
+	"deploy":      "Deployment",
+	"deployment":  "Deployment",
+	"job":         "Job",
+}
+
+// resolveWorkload turns a sts/, deploy/ or job/ target into a PVC name, or
+// into a pod/ target together with opts.Volume, for the rest of Mount. Other
+// targets are returned as they are.
+func resolveWorkload(ctx context.Context, clientset kubernetes.Interface, namespace, target string, opts *MountOptions) (string, error) {
+	prefix, name, found := strings.Cut(target, "/")
+	kind := workloadKinds[prefix]
+	if !found || name == "" {
+		// A plain PVC can be called sts or job too
+		kind = ""
+	}
+	if kind != "StatefulSet" && opts.Ordinal != nil {
+		return "", fmt.Errorf("--ordinal only applies to sts/<name> targets")
+	}
+
+	switch kind {
+	case "StatefulSet":
+		return resolveStatefulSet(ctx, clientset, namespace, name, opts)
+	case "Deployment":
+		deployment, err := clientset.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("failed to get deployment: %v", err)
+		}
+		selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+		if err != nil {
+			return "", fmt.Errorf("invalid selector of deployment %s: %v", name, err)
+		}
+		return resolvePodTemplate(ctx, clientset, namespace, kind+" "+name, &deployment.Spec.Template, selector, opts)
+	case "Job":
+		job, err := clientset.BatchV1().Jobs(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return "", fmt.Errorf("failed to get job: %v", err)
+		}
+		// The job controller always sets the selector, unless told not to
+		selector := labels.SelectorFromSet(labels.Set{"job-name": name})
+		if job.Spec.Selector != nil {
+			if selector, err = metav1.LabelSelectorAsSelector(job.Spec.Selector); err != nil {
+				return "", fmt.Errorf("invalid selector of job %s: %v", name, err)
+			}
+		}
+		return resolvePodTemplate(ctx, clientset, namespace, kind+" "+name, &job.Spec.Template, selector, opts)
+	}
+	return target, nil
+}
+
+// resolveStatefulSet finds the volume of one StatefulSet pod. Claim templates
+// name their PVCs <template>-<statefulset>-<ordinal>, so those are known even
+// when the pod isn't around, as long as the claim is still there.
+func resolveStatefulSet(ctx context.Context, clientset kubernetes.Interface, namespace, name string, opts *MountOptions) (string, error) {
+	sts, err := clientset.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to get statefulset: %v", err)
+	}
+
+	replicas := int32(1)
+	if sts.Spec.Replicas != nil {
+		replicas = *sts.Spec.Replicas
+	}
+	start := int32(0)
+	if sts.Spec.Ordinals != nil {
+		start = sts.Spec.Ordinals.Start
+	}
+	ordinal := start
+	switch {
+	case opts.Ordinal == nil && replicas == 0:
+		return "", fmt.Errorf("statefulset %s is scaled to 0, pick the pod whose volume to mount with --ordinal (from %d)", name, start)
+	case opts.Ordinal == nil && replicas != 1:
+		return "", fmt.Errorf("statefulset %s has %d replicas, pick one with --ordinal (%d to %d)", name, replicas, start, start+replicas-1)
+	case opts.Ordinal != nil:
+		ordinal = int32(*opts.Ordinal)
+	}
+	if ordinal < start {
+		return "", fmt.Errorf("statefulset %s has no ordinal %d, its ordinals start at %d", name, ordinal, start)
+	}
+	podName := fmt.Sprintf("%s-%d", name, ordinal)
+
+	volumeName := opts.Volume
+	if volumeName == "" {
+		volumeName, err = onlyVolume(fmt.Sprintf("statefulset %s", name), claimTemplateNames(sts.Spec.VolumeClaimTemplates), sts.Spec.Template.Spec.Volumes)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	for _, template := range sts.Spec.VolumeClaimTemplates {
+		if template.Name != volumeName {
+			continue
+		}
+		// The claim outlives its pod, so it's there to mount even when the
+		// StatefulSet was scaled down
+		pvcName := fmt.Sprintf("%s-%s", template.Name, podName)
+		_, err := clientset.CoreV1().PersistentVolumeClaims(namespace).Get(ctx, pvcName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return "", fmt.Errorf("statefulset %s has no PVC %s for ordinal %d", name, pvcName, ordinal)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to get PVC: %v", err)
+		}
+		fmt.Printf("Volume %s of StatefulSet %s pod %s is PVC %s\n", volumeName, name, podName, pvcName)
+		opts.Volume = ""
+		return pvcName, nil
+	}
+	for _, volume := range sts.Spec.Template.Spec.Volumes {
+		if volume.Name != volumeName {
+			continue
+		}
+		if ordinal >= start+replicas {
+			return "", fmt.Errorf("statefulset %s runs no pod %s, and volume %s only exists while it runs", name, podName, volumeName)
+		}
+		opts.Volume = volumeName
+		return PodPrefix + podName, nil
+	}
+	return "", fmt.Errorf("statefulset %s has no volume %s, it has: %s", name, volumeName, strings.Join(append(claimTemplateNames(sts.Spec.VolumeClaimTemplates), templateVolumeNames(sts.Spec.Template.Spec.Volumes)...), ", "))
+}
+
+// resolvePodTemplate finds the volume of a Deployment or Job. A PVC named in
+// the template is shared by all its pods; any other volume belongs to one
+// pod, so it's reached through the live pod that's furthest along.
+func resolvePodTemplate(ctx context.Context, clientset kubernetes.Interface, namespace, workload string, template *corev1.PodTemplateSpec, selector labels.Selector, opts *MountOptions) (string, error) {
+	volumeName := opts.Volume
+	if volumeName == "" {
+		var err error
+		volumeName, err = onlyVolume(strings.ToLower(workload), nil, template.Spec.Volumes)
+		if err != nil {
+			return "", err
+		}
+	}
+	var volume *corev1.Volume
+	for i := range template.Spec.Volumes {
+		if template.Spec.Volumes[i].Name == volumeName {
+			volume = &template.Spec.Volumes[i]
+		}
+	}
+	if volume == nil {
+		return "", fmt.Errorf("%s has no volume %s, it has: %s", strings.ToLower(workload), volumeName, strings.Join(templateVolumeNames(template.Spec.Volumes), ", "))
+	}
+
+	if volume.PersistentVolumeClaim != nil {
+		fmt.Printf("Volume %s of %s is PVC %s\n", volumeName, workload, volume.PersistentVolumeClaim.ClaimName)
+		opts.Volume = ""
+		return volume.PersistentVolumeClaim.ClaimName, nil
+	}
+
+	podList, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return "", fmt.Errorf("failed to list pods: %v", err)
+	}
+	pod, err := chooseWorkloadPod(workload, podList.Items, opts.TargetPod)
+	if err != nil {
+		return "", err
+	}
+	opts.Volume = volumeName
+	// The pod is the target now, there's nothing left to choose
+	opts.TargetPod = ""
+	return PodPrefix + pod.Name, nil
+}
+
+// chooseWorkloadPod picks the pod of a workload to reach a per-pod volume
+// through: targetPod when set, or else the live pod that's furthest along.
+func chooseWorkloadPod(workload string, pods []corev1.Pod, targetPod string) (*corev1.Pod, error) {
+	if targetPod != "" {
+		for i := range pods {
+			if pods[i].Name == targetPod {
+				return &pods[i], nil
+			}
+		}
+		return nil, fmt.Errorf("pod %s doesn't belong to %s", targetPod, workload)
+	}
+
+	sorted := rankPods(pods)
+	if len(sorted) == 0 {
+		return nil, fmt.Errorf("%s has no pods", workload)
+	}
+	rank, usage := podUsage(&sorted[0])
+	if rank == 0 {
+		return nil, fmt.Errorf("%s has no live pods:%s", workload, describeCandidates(sorted, nil))
+	}
+	fmt.Printf("Using pod %s of %s, it %s\n", sorted[0].Name, workload, usage)
+	if len(sorted) > 1 {
+		if next, _ := podUsage(&sorted[1]); next == rank {
+			fmt.Println("Pick another one with --target-pod")
+		}
+	}
+	return &sorted[0], nil
+}
+
+// onlyVolume returns the single volume a workload has, preferring claim
+// templates, and asks for --volume when there are several.
+func onlyVolume(workload string, claimTemplates []string, volumes []corev1.Volume) (string, error) {
+	candidates := claimTemplates
+	if len(candidates) == 0 {
+		candidates = templateVolumeNames(volumes)
+	}
+	switch len(candidates) {
+	case 0:
+		return "", fmt.Errorf("%s has no volumes to mount", workload)
+	case 1:
+		return candidates[0], nil
+	}
+	return "", fmt.Errorf("%s has several volumes, pick one with --volume: %s", workload, strings.Join(candidates, ", "))
+}
+
+func claimTemplateNames(templates []corev1.PersistentVolumeClaim) []string {
+	var names []string
+	for _, template := range templates {
+		names = append(names, template.Name)
+	}
+	return names
+}
+
+func templateVolumeNames(volumes []corev1.Volume) []string {
+	var names []string
+	for i := range volumes {
+		if !serviceAccountTokenVolume(&volumes[i]) {
+			names = append(names, volumes[i].Name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,207 @@
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestResolveWorkload(t *testing.T) {
+	ctx := context.Background()
+	webLabels := map[string]string{"app": "web"}
+	jobLabels := map[string]string{"job-name": "backup"}
+	sharedVolume := corev1.Volume{Name: "shared", VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "web-shared"}}}
+	shifted := testStatefulSet("kafka", 3, []string{"logs"})
+	shifted.Spec.Ordinals = &appsv1.StatefulSetOrdinals{Start: 1}
+	scaledDown := testStatefulSet("postgres", 0, []string{"data"}, cacheVolume)
+
+	tests := []struct {
+		name       string
+		objects    []runtime.Object
+		target     string
+		opts       MountOptions
+		want       string
+		wantVolume string
+		wantErr    string
+	}{
+		{
+			name:   "pvc names pass through",
+			target: "data-postgres-0",
+			want:   "data-postgres-0",
+		},
+		{
+			name:    "pvc named like a kind",
+			objects: []runtime.Object{testStatefulSet("postgres", 1, []string{"data"})},
+			target:  "job",
+			want:    "job",
+		},
+		{
+			name:   "pvc named like another kind",
+			target: "statefulset",
+			want:   "statefulset",
+		},
+		{
+			name:    "claim template",
+			objects: []runtime.Object{testStatefulSet("postgres", 1, []string{"data"}), testPVC("data-postgres-0")},
+			target:  "sts/postgres",
+			want:    "data-postgres-0",
+		},
+		{
+			name:    "claim template of the picked ordinal",
+			objects: []runtime.Object{testStatefulSet("postgres", 3, []string{"data"}), testPVC("data-postgres-2")},
+			target:  "statefulset/postgres",
+			opts:    MountOptions{Ordinal: intPtr(2)},
+			want:    "data-postgres-2",
+		},
+		{
+			name:    "several replicas need an ordinal",
+			objects: []runtime.Object{testStatefulSet("postgres", 3, []string{"data"})},
+			target:  "sts/postgres",
+			wantErr: "--ordinal (0 to 2)",
+		},
+		{
+			name:    "ordinal without a claim",
+			objects: []runtime.Object{testStatefulSet("postgres", 3, []string{"data"})},
+			target:  "sts/postgres",
+			opts:    MountOptions{Ordinal: intPtr(3)},
+			wantErr: "no PVC data-postgres-3",
+		},
+		{
+			name:    "ordinal past the replicas with a claim left",
+			objects: []runtime.Object{testStatefulSet("postgres", 3, []string{"data"}), testPVC("data-postgres-4")},
+			target:  "sts/postgres",
+			opts:    MountOptions{Ordinal: intPtr(4)},
+			want:    "data-postgres-4",
+		},
+		{
+			name:    "ordinals start elsewhere",
+			objects: []runtime.Object{shifted, testPVC("logs-kafka-3")},
+			target:  "sts/kafka",
+			opts:    MountOptions{Ordinal: intPtr(3)},
+			want:    "logs-kafka-3",
+		},
+		{
+			name:    "ordinal below the start",
+			objects: []runtime.Object{shifted, testPVC("logs-kafka-0")},
+			target:  "sts/kafka",
+			opts:    MountOptions{Ordinal: intPtr(0)},
+			wantErr: "ordinals start at 1",
+		},
+		{
+			name:    "scaled to 0",
+			objects: []runtime.Object{scaledDown, testPVC("data-postgres-1")},
+			target:  "sts/postgres",
+			opts:    MountOptions{Ordinal: intPtr(1)},
+			want:    "data-postgres-1",
+		},
+		{
+			name:    "scaled to 0 needs an ordinal",
+			objects: []runtime.Object{scaledDown, testPVC("data-postgres-0")},
+			target:  "sts/postgres",
+			wantErr: "scaled to 0",
+		},
+		{
+			name:    "scaled to 0 template volume",
+			objects: []runtime.Object{scaledDown},
+			target:  "sts/postgres",
+			opts:    MountOptions{Ordinal: intPtr(0), Volume: "cache"},
+			wantErr: "runs no pod postgres-0",
+		},
+		{
+			name:    "several claim templates need a volume",
+			objects: []runtime.Object{testStatefulSet("postgres", 1, []string{"data", "wal"})},
+			target:  "sts/postgres",
+			wantErr: "--volume: data, wal",
+		},
+		{
+			name:       "statefulset template volume",
+			objects:    []runtime.Object{testStatefulSet("postgres", 1, []string{"data"}, cacheVolume)},
+			target:     "sts/postgres",
+			opts:       MountOptions{Volume: "cache"},
+			want:       "pod/postgres-0",
+			wantVolume: "cache",
+		},
+		{
+			name:    "deployment pvc",
+			objects: []runtime.Object{testDeployment(tokenVolume, sharedVolume)},
+			target:  "deploy/web",
+			want:    "web-shared",
+		},
+		{
+			name: "deployment emptyDir through the running pod",
+			objects: []runtime.Object{
+				testDeployment(cacheVolume),
+				testPod("web-old", onNode("node-1"), withLabels(webLabels), inPhase(corev1.PodSucceeded), createdAgo(time.Hour)),
+				testPod("web-new", onNode("node-1"), withLabels(webLabels), inPhase(corev1.PodRunning), createdAgo(time.Minute)),
+				testPod("other", onNode("node-1"), withLabels(map[string]string{"app": "other"}), inPhase(corev1.PodRunning), createdAgo(2*time.Hour)),
+			},
+			target:     "deployment/web",
+			want:       "pod/web-new",
+			wantVolume: "cache",
+		},
+		{
+			name: "deployment without live pods",
+			objects: []runtime.Object{
+				testDeployment(cacheVolume),
+				testPod("web-old", onNode("node-1"), withLabels(webLabels), inPhase(corev1.PodFailed), createdAgo(time.Hour)),
+			},
+			target:  "deploy/web",
+			wantErr: "no live pods",
+		},
+		{
+			name: "job pod",
+			objects: []runtime.Object{
+				&batchv1.Job{
+					ObjectMeta: metav1.ObjectMeta{Name: "backup", Namespace: "default"},
+					Spec:       batchv1.JobSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{Volumes: []corev1.Volume{cacheVolume}}}},
+				},
+				testPod("backup-x7k2p", onNode("node-1"), withLabels(jobLabels), inPhase(corev1.PodRunning), createdAgo(time.Minute)),
+			},
+			target:     "job/backup",
+			want:       "pod/backup-x7k2p",
+			wantVolume: "cache",
+		},
+		{
+			name:    "ordinal on a deployment",
+			objects: []runtime.Object{testDeployment(sharedVolume)},
+			target:  "deploy/web",
+			opts:    MountOptions{Ordinal: intPtr(0)},
+			wantErr: "--ordinal only applies",
+		},
+		{
+			name:    "missing statefulset",
+			target:  "sts/postgres",
+			wantErr: "failed to get statefulset",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			got, err := resolveWorkload(ctx, fake.NewSimpleClientset(tt.objects...), "default", tt.target, &opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Expected an error with %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveWorkload returned an error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected target %s, got %s", tt.want, got)
+			}
+			if opts.Volume != tt.wantVolume {
+				t.Errorf("Expected volume %q, got %q", tt.wantVolume, opts.Volume)
+			}
+		})
+	}
+}